@@ -57,6 +57,11 @@ func (e *appError) Error() string {
 	return "unknown error"
 }
 
+// Unwrap returns the wrapped error, so the standard errors.As can find it.
+func (e *appError) Unwrap() error {
+	return e.Err
+}
+
 func Is(err error, code string) bool {
 	appErr, ok := err.(*appError)
 	if !ok {
@@ -0,0 +1,131 @@
+package flow
+
+import (
+	"context"
+	"time"
+
+	"github.com/necrobits/x/errors"
+)
+
+// CompensationHandler undoes the work of a completed state, e.g. refunds a captured payment.
+// It receives the current data of the flow, and returns the new data.
+// Since a compensation may be retried after a failure or a crash, it should be idempotent.
+type CompensationHandler func(ctx context.Context, data FlowData) (FlowData, error)
+
+type compensationAction struct {
+}
+
+func (a compensationAction) Type() ActionType {
+	return "Compensate"
+}
+
+// Compensate undoes the completed states of the flow in reverse order, saga-style.
+// A state is completed, when the flow has left it by a transition. Every completed state with a Compensate handler
+// is recorded, and Compensate calls these handlers from the last completed state back to the first one.
+// Afterwards, the flow transitions to the compensated state, see [CreateFlowOpts.CompensatedState].
+//
+// The progress is part of the [Snapshot]: if a compensation fails, Compensate returns its error,
+// and the remaining compensations, including the failed one, are run by the next call, also on a restored flow.
+// While the flow is compensating, it does not accept any actions, and its timers are not fired.
+// If the compensation succeeds, or a compensation fails after the progress has changed, the revision of the flow is incremented.
+// If there is nothing to compensate, Compensate does nothing.
+func (f *Flow) Compensate(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.journaling.reset()
+	compensated, err := f.compensate(ctx, time.Now())
+	f.updateRevision(compensated && err == nil)
+	return f.appendJournal(ctx, compensationAction{}, err)
+}
+
+// compensate runs the remaining compensations at the given time, and reports whether there has been anything to compensate.
+func (f *Flow) compensate(ctx context.Context, now time.Time) (bool, error) {
+	c := cause{action: compensationAction{}.Type(), from: f.currentState, at: now}
+	if !f.compensating && len(f.compensations) == 0 &&
+		(f.compensatedState == "" || f.currentState == f.states.InitialLeaf(f.compensatedState)) {
+		return false, nil
+	}
+	if !f.compensating {
+		f.compensating = true
+		f.journaling.changed = true
+	}
+	for len(f.compensations) > 0 {
+		state := f.compensations[len(f.compensations)-1]
+		f.logf("Compensating state: %s\n", state)
+		data, err := callCompensation(ctx, state, f.states[state].Compensate, f.data)
+		if err != nil {
+			f.logf("Error during compensation: %v\n", err)
+			return true, f.recordError(cause{action: c.action, from: state, at: now}, err)
+		}
+		f.setData(data)
+		f.compensations = f.compensations[:len(f.compensations)-1]
+		f.journaling.compensated = append(f.journaling.compensated, state)
+	}
+	if f.compensatedState != "" {
+		f.completed = false
+		if _, err := f.transition(ctx, c, f.data, f.states.InitialLeaf(f.compensatedState)); err != nil {
+			return true, err
+		}
+	}
+	f.compensating = false
+	f.logf("Flow compensated\n")
+	return true, nil
+}
+
+// IsCompensating reports whether the compensation of the flow has started, but not finished yet.
+func (f *Flow) IsCompensating() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.compensating
+}
+
+// Compensations returns the completed states, which are compensated by [Flow.Compensate], in the order of their completion.
+func (f *Flow) Compensations() []State {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.copyCompensations()
+}
+
+func (f *Flow) copyCompensations() []State {
+	if len(f.compensations) == 0 {
+		return nil
+	}
+	return append([]State(nil), f.compensations...)
+}
+
+// WithCompensatedState sets the state, which the flow transitions to after its compensation.
+// This is useful for flows restored from a snapshot, see [CreateFlowOpts.CompensatedState].
+func (f *Flow) WithCompensatedState(state State) *Flow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.compensatedState = state
+	return f
+}
+
+// recordCompensations records the exited states, which have a Compensate handler, as completed.
+// The states exited by the compensation itself are not recorded.
+func (f *Flow) recordCompensations(exited []State) {
+	if f.compensating {
+		return
+	}
+	for _, state := range exited {
+		if f.states[state].Compensate != nil {
+			f.compensations = append(f.compensations, state)
+		}
+	}
+}
+
+// replayCompensations removes the recorded compensated states from the completed states.
+func (f *Flow) replayCompensations(compensated []State) error {
+	for _, state := range compensated {
+		last := len(f.compensations) - 1
+		if last < 0 || f.compensations[last] != state {
+			return errors.B().
+				Code(ErrInvalidJournal).
+				Op("flow.Replay").
+				Msgf("journal compensates state %s, which is not the last completed state", state).Build()
+		}
+		f.compensations = f.compensations[:last]
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/necrobits/x/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type sagaData struct {
+	Reserved bool
+	Charged  bool
+	Undone   []State
+}
+
+func sagaTable(refundFailures *int) TransitionTable {
+	undo := func(state State, apply func(saga *sagaData)) CompensationHandler {
+		return func(ctx context.Context, data FlowData) (FlowData, error) {
+			saga := *data.(*sagaData)
+			apply(&saga)
+			saga.Undone = append(append([]State(nil), saga.Undone...), state)
+			return &saga, nil
+		}
+	}
+	refund := undo("Charging", func(saga *sagaData) { saga.Charged = false })
+	return TransitionTable{
+		"Reserving": StateConfig{
+			Handler: func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+				return "Reserved", &sagaData{Reserved: true}, nil
+			},
+			Transitions: Transitions{"Reserved": "Charging"},
+			Compensate:  undo("Reserving", func(saga *sagaData) { saga.Reserved = false }),
+		},
+		"Charging": StateConfig{
+			Handler: func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+				saga := *data.(*sagaData)
+				saga.Charged = true
+				return "Charged", &saga, nil
+			},
+			Transitions: Transitions{"Charged": "Shipping"},
+			Compensate: func(ctx context.Context, data FlowData) (FlowData, error) {
+				if *refundFailures > 0 {
+					*refundFailures--
+					return nil, fmt.Errorf("refund failed")
+				}
+				return refund(ctx, data)
+			},
+		},
+		"Shipping": StateConfig{
+			Handler:     emit("ShipmentFailed"),
+			Transitions: Transitions{"ShipmentFailed": "Failed"},
+		},
+		"Failed":      StateConfig{Final: true},
+		"Compensated": StateConfig{Final: true},
+	}
+}
+
+// failedSaga creates a saga, which has failed after completing the states Reserving and Charging.
+func failedSaga(t *testing.T, refundFailures *int) *Flow {
+	f := newTestFlow(sagaTable(refundFailures), "Reserving", &sagaData{}).
+		WithCompensatedState("Compensated").
+		WithHistory(HistoryPolicy{})
+	for _, action := range []ActionType{"Reserve", "Charge", "Ship"} {
+		require.NoError(t, f.HandleAction(context.Background(), testAction{action}))
+	}
+	require.Equal(t, State("Failed"), f.CurrentState())
+	require.Equal(t, []State{"Reserving", "Charging"}, f.Compensations())
+	return f
+}
+
+func TestCompensate(t *testing.T) {
+	ctx := context.Background()
+	t.Run("ReverseOrder", func(t *testing.T) {
+		f := failedSaga(t, new(int))
+		require.NoError(t, f.Compensate(ctx))
+		require.Equal(t, &sagaData{Undone: []State{"Charging", "Reserving"}}, f.Data())
+		require.Equal(t, State("Compensated"), f.CurrentState())
+		require.True(t, f.IsCompleted())
+		require.False(t, f.IsCompensating())
+		require.Empty(t, f.Compensations())
+
+		history := f.History()
+		require.Equal(t, ActionType("Compensate"), history[len(history)-1].ActionType)
+		require.Equal(t, State("Compensated"), history[len(history)-1].To)
+
+		revision := f.Revision()
+		require.NoError(t, f.Compensate(ctx))
+		require.Equal(t, revision, f.Revision())
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		failures := 1
+		f := failedSaga(t, &failures)
+		require.Error(t, f.Compensate(ctx))
+		require.True(t, f.IsCompensating())
+		require.Equal(t, []State{"Reserving", "Charging"}, f.Compensations())
+		require.Equal(t, State("Failed"), f.CurrentState())
+
+		snapshot, err := f.ToSnapshot()
+		require.NoError(t, err)
+		encoded, err := json.Marshal(snapshot)
+		require.NoError(t, err)
+		var decoded Snapshot
+		require.NoError(t, json.Unmarshal(encoded, &decoded))
+		saga := &sagaData{}
+		require.NoError(t, json.Unmarshal(decoded.EncodedData, saga))
+		decoded.Data = saga
+
+		restored := FromSnapshot(&decoded, sagaTable(&failures)).WithCompensatedState("Compensated")
+		require.True(t, restored.IsCompensating())
+		require.NoError(t, restored.Compensate(ctx))
+		require.Equal(t, &sagaData{Undone: []State{"Charging", "Reserving"}}, restored.Data())
+		require.Equal(t, State("Compensated"), restored.CurrentState())
+	})
+
+	t.Run("RejectsActions", func(t *testing.T) {
+		failures := 1
+		f := New(CreateFlowOpts{
+			ID:              "1",
+			Type:            "Order",
+			Data:            &sagaData{},
+			InitialState:    "Reserving",
+			TransitionTable: sagaTable(&failures),
+		})
+		require.NoError(t, f.HandleAction(ctx, testAction{"Reserve"}))
+		require.NoError(t, f.HandleAction(ctx, testAction{"Charge"}))
+		require.Error(t, f.Compensate(ctx))
+
+		err := f.HandleAction(ctx, testAction{"Ship"})
+		require.True(t, errors.Is(err, ErrCompensating))
+		require.NoError(t, f.Compensate(ctx))
+		require.False(t, f.IsCompensating())
+		require.Equal(t, State("Shipping"), f.CurrentState())
+		require.NoError(t, f.HandleAction(ctx, testAction{"Ship"}))
+		require.Equal(t, State("Failed"), f.CurrentState())
+	})
+}
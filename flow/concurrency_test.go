@@ -0,0 +1,147 @@
+package flow
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// These tests are meant to be run with the race detector: go test -race
+func TestConcurrentUse(t *testing.T) {
+	ctx := context.Background()
+	const workers = 20
+	const actionsPerWorker = 25
+	increment := func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+		counter := *data.(*orderData)
+		counter.Amount++
+		return NoEvent, &counter, nil
+	}
+	table := TransitionTable{
+		"Counting": StateConfig{
+			Handler:     increment,
+			After:       []Timer{{Delay: time.Millisecond, Event: "Tick"}},
+			Transitions: Transitions{"Tick": "Counting"},
+		},
+	}
+	// runWorkers runs the work in parallel, and returns the first error of the workers.
+	// The errors are checked on the test goroutine, since t.FailNow must not be called from the workers.
+	runWorkers := func(work func() error) error {
+		var wg sync.WaitGroup
+		errs := make(chan error, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- work()
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	handleActions := func(f *Flow) func() error {
+		return func() error {
+			for i := 0; i < actionsPerWorker; i++ {
+				if err := f.HandleAction(ctx, testAction{"Increment"}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	t.Run("Actions", func(t *testing.T) {
+		f := newTestFlow(table, "Counting", &orderData{}).WithHistory(HistoryPolicy{MaxEntries: 10})
+		require.NoError(t, runWorkers(handleActions(f)))
+		require.Equal(t, &orderData{Amount: workers * actionsPerWorker}, f.Data())
+		require.Equal(t, uint64(workers*actionsPerWorker), f.Revision())
+	})
+
+	t.Run("ActionsAndReads", func(t *testing.T) {
+		f := newTestFlow(table, "Counting", &orderData{}).WithHistory(HistoryPolicy{MaxEntries: 10})
+		var readers sync.WaitGroup
+		readErrs := make(chan error, 4)
+		for i := 0; i < 4; i++ {
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				for i := 0; i < actionsPerWorker; i++ {
+					_ = f.CurrentState()
+					_ = f.CurrentStatePath()
+					_ = f.ActiveStates()
+					_ = f.Data()
+					_ = f.Deadlines()
+					_ = f.History()
+					_ = f.IsCompleted()
+					_ = f.IsExpired()
+					_ = f.Revision()
+					if _, err := f.ToSnapshot(); err != nil {
+						readErrs <- err
+						return
+					}
+				}
+			}()
+		}
+		require.NoError(t, runWorkers(handleActions(f)))
+		readers.Wait()
+		close(readErrs)
+		for err := range readErrs {
+			require.NoError(t, err)
+		}
+		require.Equal(t, &orderData{Amount: workers * actionsPerWorker}, f.Data())
+	})
+
+	t.Run("ActionsAndTicks", func(t *testing.T) {
+		f := newTestFlow(table, "Counting", &orderData{}).WithHistory(HistoryPolicy{MaxEntries: 10})
+		require.NoError(t, runWorkers(func() error {
+			for i := 0; i < actionsPerWorker; i++ {
+				if err := f.HandleAction(ctx, testAction{"Increment"}); err != nil {
+					return err
+				}
+				if err := f.Tick(ctx, time.Now().Add(2*time.Millisecond)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		require.Equal(t, &orderData{Amount: workers * actionsPerWorker}, f.Data())
+		require.Len(t, f.Deadlines(), 1)
+	})
+
+	t.Run("ActionsAndHookRegistration", func(t *testing.T) {
+		f := New(CreateFlowOpts{
+			ID:              "1",
+			Type:            "ConcurrentHooks",
+			Data:            &orderData{},
+			InitialState:    "Counting",
+			TransitionTable: table,
+		})
+		var mu sync.Mutex
+		calls := 0
+		countCall := func(ctx context.Context, data FlowData) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+		}
+		require.NoError(t, runWorkers(func() error {
+			for i := 0; i < actionsPerWorker; i++ {
+				f.RegisterPostTransition("Counting", countCall)
+				HookRegistry().RegisterPostTransition("ConcurrentHooks", "Counting", countCall)
+				f.SetExpirationIn(time.Hour)
+				if err := f.HandleAction(ctx, testAction{"Increment"}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		require.Positive(t, calls)
+	})
+}
@@ -0,0 +1,117 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Definition describes a type of flow: its states, its handlers and its options.
+// Unlike CreateFlowOpts, it does not contain anything specific to a single flow,
+// so it can be used to create the flows of the type, and to restore them from a Snapshot or a Journal.
+type Definition struct {
+	// Type is the type of the flows.
+	Type FlowType
+	// InitialState is the initial state of new flows.
+	InitialState State
+	// TransitionTable contains the description of the state machine.
+	TransitionTable TransitionTable
+	// Handler is the default handler, see [CreateFlowOpts.Handler].
+	Handler ActionHandler
+	// Middlewares wrap the handler of every action, see [CreateFlowOpts.Middlewares].
+	Middlewares []Middleware
+	// OnHookPanic is called with the recovered panic of a post-transition or completion hook, see [CreateFlowOpts.OnHookPanic].
+	OnHookPanic func(ctx context.Context, err error)
+	// ExpireIn is the duration after which new flows expire, see [CreateFlowOpts.ExpireIn].
+	ExpireIn time.Duration
+	// ExpirationEvent is the event fired when a flow has expired, see [CreateFlowOpts.ExpirationEvent].
+	ExpirationEvent Event
+	// ExpirationState is the state entered when a flow has expired, see [CreateFlowOpts.ExpirationState].
+	ExpirationState State
+	// Version is the version of the definition. It is stored in the snapshots of the flows.
+	// When the structure of the flows changes, e.g. a state is renamed, the version should be incremented,
+	// and a migration from the previous version should be added.
+	Version int
+	// Migrations migrate the snapshots of previous versions to the current version, see [Definition.Migrate].
+	Migrations []Migration
+	// MaxAutopassChain is the maximum number of automatic transitions following an action, see [CreateFlowOpts.MaxAutopassChain].
+	MaxAutopassChain int
+	// History is the history policy, see [CreateFlowOpts.History].
+	History *HistoryPolicy
+	// CompensatedState is the state, which the flows transition to after their compensation, see [CreateFlowOpts.CompensatedState].
+	CompensatedState State
+	// SnapshotInterval is the number of journal entries between two snapshots, when the flows are journaled.
+	// Defaults to [DefaultSnapshotInterval].
+	SnapshotInterval int
+	// DecodeData decodes the marshalled data of a flow, e.g. using the Unmarshal method of a flowregistry.DataRegistry.
+	// It is required to replay a flow from a Journal, and to restore a snapshot, whose data is changed by a migration.
+	DecodeData func(data json.RawMessage) (FlowData, error)
+}
+
+// New creates a new flow of the defined type.
+func (d *Definition) New(id string, data FlowData) *Flow {
+	return New(CreateFlowOpts{
+		ID:               id,
+		Type:             d.Type,
+		Data:             data,
+		InitialState:     d.InitialState,
+		TransitionTable:  d.TransitionTable,
+		Handler:          d.Handler,
+		Middlewares:      d.Middlewares,
+		OnHookPanic:      d.OnHookPanic,
+		ExpireIn:         d.ExpireIn,
+		ExpirationEvent:  d.ExpirationEvent,
+		ExpirationState:  d.ExpirationState,
+		MaxAutopassChain: d.MaxAutopassChain,
+		History:          d.History,
+		CompensatedState: d.CompensatedState,
+		Version:          d.Version,
+	})
+}
+
+// Restore restores a flow of the defined type from a Snapshot, whose data is already decoded.
+// Unlike FromSnapshot, the options of the definition are applied to the restored flow.
+// A snapshot of a previous version of the definition is migrated first, see [Definition.Migrate].
+// If a migration has changed the encoded data, it is decoded again with DecodeData.
+// If the snapshot cannot be migrated, an error with the code [ErrNoMigrationPath] is returned.
+func (d *Definition) Restore(s *Snapshot) (*Flow, error) {
+	if err := d.migrateDecoded(s); err != nil {
+		return nil, err
+	}
+	return d.restore(s), nil
+}
+
+// restore restores a flow from a snapshot, which has the version of the definition.
+func (d *Definition) restore(s *Snapshot) *Flow {
+	f := FromSnapshot(s, d.TransitionTable).
+		WithDefaultActionHandler(d.Handler).
+		WithMiddlewares(d.Middlewares...).
+		WithOnHookPanic(d.OnHookPanic).
+		WithMaxAutopassChain(d.MaxAutopassChain).
+		WithCompensatedState(d.CompensatedState).
+		WithExpiration(d.ExpirationEvent, d.ExpirationState)
+	if d.History != nil {
+		f.WithHistory(*d.History)
+	}
+	return f
+}
+
+// Hydrate restores a flow of the defined type like Restore, and runs the hydration hooks of the global registry on its data.
+func (d *Definition) Hydrate(ctx context.Context, s *Snapshot) (*Flow, error) {
+	f, err := d.Restore(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.hydrate(ctx); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *Definition) decodeData(data json.RawMessage) (FlowData, error) {
+	if d.DecodeData == nil {
+		return nil, fmt.Errorf("no data decoder for flow type: %s", d.Type)
+	}
+	return d.DecodeData(data)
+}
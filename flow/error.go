@@ -0,0 +1,38 @@
+package flow
+
+const (
+	// ErrNoPassingGuard is returned when an event has guarded transitions, but none of the guards passes.
+	ErrNoPassingGuard = "no_passing_guard"
+	// ErrNoRoute is returned by an action router, when there is no route for the type of the action.
+	ErrNoRoute = "no_route"
+	// ErrInvalidTransitionTable is returned when a TransitionTable does not pass the validation.
+	ErrInvalidTransitionTable = "invalid_transition_table"
+	// ErrAutopassLimitExceeded is returned when an action is followed by too many automatic transitions,
+	// which usually means that autopass states form a cycle.
+	ErrAutopassLimitExceeded = "autopass_limit_exceeded"
+	// ErrInvalidJournal is returned when the entries of a journal cannot be replayed,
+	// e.g. because an entry is missing or refers to an unknown state.
+	ErrInvalidJournal = "invalid_journal"
+	// ErrCompensating is returned when an action is handled, while the flow is compensating, see [Flow.Compensate].
+	ErrCompensating = "compensating"
+	// ErrNoMigrationPath is returned when a snapshot cannot be migrated to the version of its definition.
+	ErrNoMigrationPath = "no_migration_path"
+	// ErrPanic is returned when an action handler, a guard or a hook panics. The panic is recovered,
+	// and the error wraps a [PanicError] with the recovered value and the stack.
+	// The panic of a post-transition or completion hook is not returned, but passed to [CreateFlowOpts.OnHookPanic].
+	ErrPanic = "panic"
+	// ErrFlowCompleted is returned when an action is handled, but the flow is already completed.
+	ErrFlowCompleted = "flow_completed"
+	// ErrFlowExpired is returned when an action is handled or a timer is fired, but the flow has expired,
+	// and it has no expiration transition, see [Flow.Expire].
+	ErrFlowExpired = "flow_expired"
+	// ErrNoTransition is returned when the event returned by a handler, or fired by a timer, has no transition
+	// from the current state.
+	ErrNoTransition = "no_transition"
+	// ErrIllegalState is returned when the current state of the flow does not exist in its TransitionTable.
+	ErrIllegalState = "illegal_state"
+	// ErrNoHandler is returned when an action is handled, but neither the current state nor the flow has a handler.
+	ErrNoHandler = "no_handler"
+	// ErrRegionCrossing is returned when a transition leads from a region of a parallel state into another region.
+	ErrRegionCrossing = "region_crossing"
+)
@@ -0,0 +1,80 @@
+package flow
+
+import (
+	"context"
+	"time"
+)
+
+type expirationAction struct {
+}
+
+func (a expirationAction) Type() ActionType {
+	return "Expire"
+}
+
+// Expire moves an expired flow along its expiration transition, see [CreateFlowOpts.ExpirationEvent]
+// and [CreateFlowOpts.ExpirationState]. The transition goes through the same hooks as any other transition,
+// so if it reaches a final state, the flow is completed and its completion hooks are called.
+// Afterwards, the flow does not expire anymore, unless a new expiration is set.
+//
+// Expire does nothing, if the flow has not expired at the given time, if it is completed or compensating,
+// or if no expiration transition is configured. If the flow has expired, the revision of the flow is incremented like by [Flow.HandleAction].
+// Like [Flow.Tick], Expire can be called on a restored flow, e.g. by a sweeper scanning the stored flows.
+func (f *Flow) Expire(ctx context.Context, now time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.journaling.reset()
+	expired, err := f.expire(ctx, now)
+	f.updateRevision(expired && err == nil)
+	return f.appendJournal(ctx, expirationAction{}, err)
+}
+
+// expire follows the expiration transition, and reports whether the flow has expired.
+// If the transition fails, the flow remains expired in its current state, so the expiration can be retried.
+func (f *Flow) expire(ctx context.Context, now time.Time) (bool, error) {
+	if f.completed || f.compensating || !f.isExpiredAt(now) || !f.hasExpirationTransition() {
+		return false, nil
+	}
+	c := cause{action: expirationAction{}.Type(), event: f.expirationEvent, from: f.currentState, at: now}
+	nextState, err := f.resolveExpiration(ctx)
+	if err != nil {
+		f.logf("Error: %v\n", err)
+		return true, f.recordError(c, err)
+	}
+	f.logf("Flow expired\n")
+	pending, err := f.transition(ctx, c, f.data, nextState)
+	if err != nil {
+		return true, err
+	}
+	f.expiresAt = time.Time{}
+	f.journaling.expired = true
+	return true, f.runAutomaticTransitions(ctx, pending, nil, now)
+}
+
+// resolveExpiration finds the target of the expiration transition.
+// The expiration event is resolved like any other event, and the expiration state is the fallback,
+// if the event has no transition from the current state.
+func (f *Flow) resolveExpiration(ctx context.Context) (State, error) {
+	if f.expirationEvent == "" {
+		return f.states.InitialLeaf(f.expirationState), nil
+	}
+	nextState, err := f.resolveTransition(ctx, f.currentState, f.expirationEvent, f.data)
+	if err != nil && f.expirationState != "" {
+		return f.states.InitialLeaf(f.expirationState), nil
+	}
+	return nextState, err
+}
+
+func (f *Flow) hasExpirationTransition() bool {
+	return f.expirationEvent != "" || f.expirationState != ""
+}
+
+// WithExpiration sets the expiration transition of the flow.
+// This is useful for flows restored from a snapshot, see [CreateFlowOpts.ExpirationEvent] and [CreateFlowOpts.ExpirationState].
+func (f *Flow) WithExpiration(event Event, state State) *Flow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expirationEvent = event
+	f.expirationState = state
+	return f
+}
@@ -0,0 +1,103 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// expiredFlow creates a flow awaiting the payment, which has expired a minute ago.
+func expiredFlow(event Event, state State) *Flow {
+	f := newTestFlow(paymentTimeoutTable(), "AwaitingPayment", nil).WithExpiration(event, state)
+	f.SetExpirationAt(time.Now().Add(-time.Minute))
+	return f
+}
+
+func TestExpire(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Event", func(t *testing.T) {
+		f := expiredFlow("PaymentTimedOut", "")
+		completed := 0
+		f.RegisterCompletionHook("", func(ctx context.Context, data FlowData) {
+			completed++
+		})
+		require.NoError(t, f.Expire(ctx, time.Now()))
+		require.Equal(t, State("Canceled"), f.CurrentState())
+		require.True(t, f.IsCompleted())
+		require.False(t, f.IsExpired())
+		require.True(t, f.ExpiresAt().IsZero())
+		require.Equal(t, uint64(1), f.Revision())
+		require.Equal(t, 1, completed)
+	})
+
+	t.Run("StateFallback", func(t *testing.T) {
+		f := expiredFlow("Expired", "Canceled")
+		require.NoError(t, f.Expire(ctx, time.Now()))
+		require.Equal(t, State("Canceled"), f.CurrentState())
+	})
+
+	t.Run("NotExpired", func(t *testing.T) {
+		f := expiredFlow("", "Canceled")
+		require.NoError(t, f.Expire(ctx, time.Now().Add(-time.Hour)))
+		require.Equal(t, State("AwaitingPayment"), f.CurrentState())
+		require.Equal(t, uint64(0), f.Revision())
+	})
+
+	t.Run("HandleAction", func(t *testing.T) {
+		f := expiredFlow("", "AwaitingPaymentReminded")
+		require.NoError(t, f.HandleAction(ctx, testAction{"Pay"}))
+		require.Equal(t, State("Shipping"), f.CurrentState())
+		require.Equal(t, uint64(2), f.Revision())
+	})
+
+	t.Run("Tick", func(t *testing.T) {
+		f := expiredFlow("PaymentTimedOut", "")
+		require.NoError(t, f.Tick(ctx, time.Now()))
+		require.Equal(t, State("Canceled"), f.CurrentState())
+		require.Empty(t, f.Deadlines())
+	})
+
+	t.Run("Unconfigured", func(t *testing.T) {
+		f := expiredFlow("", "")
+		require.NoError(t, f.Expire(ctx, time.Now()))
+		require.True(t, f.IsExpired())
+		require.Error(t, f.HandleAction(ctx, testAction{"Pay"}))
+		require.Equal(t, State("AwaitingPayment"), f.CurrentState())
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		f := expiredFlow("", "Canceled")
+		failures := 1
+		f.RegisterPreTransition("Canceled", func(ctx context.Context, data FlowData) error {
+			if failures > 0 {
+				failures--
+				return fmt.Errorf("cannot cancel")
+			}
+			return nil
+		})
+		require.Error(t, f.Expire(ctx, time.Now()))
+		require.True(t, f.IsExpired())
+		require.Equal(t, State("AwaitingPayment"), f.CurrentState())
+		require.NoError(t, f.Expire(ctx, time.Now()))
+		require.Equal(t, State("Canceled"), f.CurrentState())
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		def := &Definition{
+			Type:            "Order",
+			InitialState:    "AwaitingPayment",
+			TransitionTable: paymentTimeoutTable(),
+			ExpirationState: "Canceled",
+		}
+		snapshot, err := expiredFlow("", "").ToSnapshot()
+		require.NoError(t, err)
+		f, err := def.Restore(snapshot)
+		require.NoError(t, err)
+		require.NoError(t, f.Expire(ctx, time.Now()))
+		require.Equal(t, State("Canceled"), f.CurrentState())
+	})
+}
@@ -5,12 +5,17 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
+
+	"github.com/necrobits/x/errors"
 )
 
 const (
 	// NoEvent is a special event, which is used to indicate that no event is sent to the state machine.
 	NoEvent Event = ""
+	// DefaultMaxAutopassChain is the default maximum number of automatic transitions following an action.
+	DefaultMaxAutopassChain = 100
 )
 
 var (
@@ -20,21 +25,51 @@ var (
 // Flow is the state machine.
 // It contains the internal data of the flow, and the current state.
 // It also contains the transition table, which describes the state machine.
+//
+// A Flow is safe for concurrent use. Actions and ticks are handled one at a time, and the accessors
+// never observe a transition half-way. Handlers and hooks are called while the flow is locked,
+// so they must not call the methods of the flow themselves.
 type Flow struct {
-	id              string
-	flowType        FlowType
-	data            FlowData
-	currentState    State
-	states          TransitionTable
-	defaultHandler  ActionHandler
-	expiresAt       time.Time
-	completed       bool
-	hookTable       preTransitionHookTable
-	postHookTable   silentHookTable
-	completionHooks []silentHookFn
+	mu               sync.RWMutex
+	id               string
+	flowType         FlowType
+	data             FlowData
+	currentState     State
+	regions          map[State]State
+	enteredAt        time.Time
+	deadlines        []Deadline
+	states           TransitionTable
+	defaultHandler   ActionHandler
+	middlewares      []Middleware
+	expiresAt        time.Time
+	expirationEvent  Event
+	expirationState  State
+	completed        bool
+	compensations    []State
+	compensating     bool
+	compensatedState State
+	child            *Flow
+	childState       State
+	revision         uint64
+	version          int
+	maxAutopass      int
+	journaling       journaling
+	history          []HistoryEntry
+	historyPolicy    *HistoryPolicy
+	hookTable        preTransitionHookTable
+	postHookTable    silentHookTable
+	completionHooks  []silentHookFn
+	onHookPanic      func(ctx context.Context, err error)
 }
 
-var _ StateMachine = (*Flow)(nil)
+var (
+	_ StateMachine = (*Flow)(nil)
+	_ Ticker       = (*Flow)(nil)
+	_ Expirer      = (*Flow)(nil)
+	_ Compensator  = (*Flow)(nil)
+	_ Querier      = (*Flow)(nil)
+	_ Recorder     = (*Flow)(nil)
+)
 
 // FlowData is the internal data of the flow. This can be anything.
 type FlowData interface{}
@@ -93,11 +128,37 @@ type CreateFlowOpts struct {
 	TransitionTable TransitionTable
 	// Handler is the default handler for the flow. If a state does not have a handler, this handler is used.
 	Handler ActionHandler
+	// Middlewares wrap the handler of every action of the flow, see [Middleware].
+	Middlewares []Middleware
+	// OnHookPanic is called with the recovered panic of a post-transition or completion hook, see [Flow.WithOnHookPanic].
+	// A panic of the callback itself is recovered and logged.
+	OnHookPanic func(ctx context.Context, err error)
 	// ExpireAt is the time at which the flow expires.
 	ExpireAt time.Time
 	// ExpireIn is the duration after which the flow expires.
 	// If both ExpireAt and ExpireIn are set, ExpireIn is used.
 	ExpireIn time.Duration
+	// ExpirationEvent is the event, which is fired when the flow has expired, see [Flow.Expire].
+	// It is resolved like an event returned by an action handler. If it is empty, ExpirationState is used.
+	ExpirationEvent Event
+	// ExpirationState is the state, which the flow transitions to when it has expired, see [Flow.Expire].
+	// If ExpirationEvent is set as well, it is only used when the event has no transition from the current state.
+	// If neither is set, an expired flow just rejects all actions.
+	ExpirationState State
+	// MaxAutopassChain is the maximum number of automatic transitions, e.g. of autopass states, following an action.
+	// If the limit is reached, the action fails with [ErrAutopassLimitExceeded]. Defaults to [DefaultMaxAutopassChain].
+	MaxAutopassChain int
+	// Strict enables the validation of the TransitionTable using [Validate].
+	// In strict mode, New panics if the table is invalid. States without a handler are accepted if Handler is set.
+	Strict bool
+	// History enables the history of the flow, which records every transition and failed action.
+	// The history is bounded by the policy, and it is persisted in the [Snapshot]. If it is nil, no history is recorded.
+	History *HistoryPolicy
+	// CompensatedState is the state, which the flow transitions to after [Flow.Compensate] has compensated all completed states.
+	// If it is empty, the flow remains in its current state.
+	CompensatedState State
+	// Version is the version of the TransitionTable. It is stored in the [Snapshot], so it can be migrated, see [Migration].
+	Version int
 }
 
 // Snapshot is used to persist the flow, and restore it later.
@@ -110,8 +171,32 @@ type Snapshot struct {
 	EncodedData json.RawMessage `json:"data"`
 	// Data is the decoded data of the flow. Must be marshallable
 	Data FlowData `json:"-"`
-	// CurrentState of the original flow.
+	// CurrentState of the original flow. For nested states, this is the innermost state,
+	// the active path is derived from the TransitionTable when the flow is restored.
+	// For a parallel state, this is the parallel state itself, and the active states are stored in Regions.
 	CurrentState State `json:"current_state"`
+	// Regions contains the active state of each region, when the flow is in a parallel state.
+	Regions map[State]State `json:"regions,omitempty"`
+	// EnteredAt is the time at which the flow entered its current state.
+	EnteredAt time.Time `json:"entered_at"`
+	// Deadlines contains the pending timers of the active states.
+	Deadlines []Deadline `json:"deadlines,omitempty"`
+	// History contains the recorded transitions of the flow, if the history is enabled.
+	History []HistoryEntry `json:"history,omitempty"`
+	// Revision is the number of actions, which the flow has handled successfully or which have changed it before failing,
+	// e.g. by adding the failure to its history. It is used to detect concurrent changes, when the flow is saved.
+	Revision uint64 `json:"revision"`
+	// Version is the version of the TransitionTable, with which the snapshot was taken.
+	Version int `json:"version,omitempty"`
+	// Compensations contains the completed states, which are compensated by [Flow.Compensate], in the order of their completion.
+	Compensations []State `json:"compensations,omitempty"`
+	// Compensating indicates whether the compensation of the flow has started, but not finished yet.
+	Compensating bool `json:"compensating,omitempty"`
+	// Child is the snapshot of the running child flow, if the current state invokes a sub-flow.
+	// When the flow is restored, its data must be decoded like the data of the flow.
+	Child *Snapshot `json:"child,omitempty"`
+	// JournalSeq is the sequence number of the last journal entry included in the snapshot.
+	JournalSeq uint64 `json:"journal_seq,omitempty"`
 	// ExpiresAt is the time at which the flow expires.
 	ExpiresAt sql.NullTime `json:"expire_at"`
 	// IsCompleted indicates whether the flow is completed or not.
@@ -135,81 +220,320 @@ type Transitions map[Event]State
 // When the flow is in a state, and an action is received, the handler function of that state is called.
 // If you are going to handle one action in a state, you may consider using the [TypedHandler] function to avoid type assertion.
 // If you are going to handle multiple actions in a state, you may consider using the [NewRouter] function create an action router.
+//
+// States can be nested by setting a Parent. A parent state (compound state) shares its handler and transitions
+// with all of its children: when the flow is in a child state, the handler and the transitions are resolved
+// from the child outward to its ancestors.
 type StateConfig struct {
 	// Handler is the handler function for the state. It receives the current internal data of the flow, and the action.
+	// If it is nil, the handler of the closest ancestor is used.
 	Handler ActionHandler
+	// Actions declares the types of the actions, which are accepted in the state and its children, see [Flow.AvailableActions].
+	// Actions of other types are passed to the handler as well, but [Flow.CanHandle] only accepts the declared types.
+	// For a router, the action types can be taken from [actionRouter.ActionTypes].
+	Actions []ActionType
+	// Middlewares wrap the handler of every action, which is handled while the state is active, see [Middleware].
+	// The middlewares of an ancestor wrap the middlewares of its children.
+	Middlewares []Middleware
 	// Transitions is a map, describing the transition from a state to the next state when an event occurs.
 	Transitions Transitions
+	// GuardedTransitions describes the ordered candidate targets of an event, each with a guard.
+	// If an event is found in GuardedTransitions, it takes precedence over Transitions.
+	// If none of the guards passes, the action fails with [ErrNoPassingGuard].
+	GuardedTransitions GuardedTransitions
 	// Final indicates whether the state is a final state or not. If the Flow reachs a final state, it is completed.
 	Final bool
 	// Autopass indicates the state will automatically transition to the next state without any action.
 	// The handler function will be called with an [AutopassAction].
 	Autopass bool
+	// Parent is the compound state containing this state.
+	Parent State
+	// Initial is the child state, which is entered when the flow transitions to this state.
+	// It must be set for a compound state.
+	Initial State
+	// Regions makes the state a parallel state. Each region is a compound child state of this state,
+	// and the flow is in one state of every region at the same time.
+	// Actions are routed to every active region, in the order of Regions.
+	// If no region handles an action, it is handled by the parallel state itself.
+	Regions []State
+	// DoneEvent is the event, which is raised when all regions of a parallel state have reached a final state.
+	// It is resolved from the transitions of the parallel state outward. If it is empty, the flow stays in the parallel state.
+	DoneEvent Event
+	// After contains the timers of the state. When the flow stays in the state for the delay of a timer,
+	// the event of the timer is fired. The timers are started when the state is entered, and stopped when it is exited.
+	// Due timers are fired by [Flow.Tick].
+	After []Timer
+	// OnEntry is called when the flow enters the state, after the pre-transition hooks of the next state.
+	// When a nested state is entered, the entry actions are called from the outermost entered state.
+	// It is not called for the initial state of a newly created flow.
+	// If it returns an error, the transition is aborted and the flow remains in the same state.
+	OnEntry hookFn
+	// Invoke starts a child flow of another type, while the flow is in the state. See [SubFlow].
+	Invoke *SubFlow
+	// OnExit is called when the flow exits the state, before the pre-transition hooks of the next state.
+	// When a nested state is exited, the exit actions are called from the innermost exited state.
+	// If it returns an error, the transition is aborted and the flow remains in the same state.
+	OnExit hookFn
+	// Compensate undoes the work of the state, after the flow has left it. See [Flow.Compensate].
+	Compensate CompensationHandler
+	// Except excludes states, and their children, from the global transitions.
+	// It is only used in the config of [AnyState].
+	Except []State
 }
 
 // HandleAction handles an action for the flow.
 // Everytime an action is handled, the flow may change its state.
 // This function is the only way to change the state of the flow.
+// If the action is handled successfully, the revision of the flow is incremented.
+// If it fails after the flow has changed, e.g. when an automatic transition fails or the maximum autopass chain
+// is exceeded, the flow is not rolled back: it remains in the last state it has reached, and the revision is incremented as well,
+// so the change can be saved. The same applies, if the flow records its history, since the failed action is added to it.
+// Otherwise, a failed action leaves the flow and its revision as they were.
+// If the flow has a journal, the outcome of the action is appended to it, see [Flow.AttachJournal].
+//
+// If the flow has expired and an expiration transition is configured, the flow expires first, like [Flow.Expire],
+// and the action is handled in the state reached by the expiration afterwards.
 func (f *Flow) HandleAction(ctx context.Context, a Action) error {
-	if f.completed {
-		return fmt.Errorf("flow is completed")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.journaling.reset()
+	now := time.Now()
+	if expired, err := f.expire(ctx, now); expired {
+		f.updateRevision(err == nil)
+		if err := f.appendJournal(ctx, expirationAction{}, err); err != nil {
+			return err
+		}
+		f.journaling.reset()
 	}
-	if f.IsExpired() {
-		return fmt.Errorf("flow expired")
+	pending, err := f.handleAction(ctx, a, now)
+	err = f.runAutomaticTransitions(ctx, pending, err, now)
+	f.updateRevision(err == nil)
+	return f.appendJournal(ctx, a, err)
+}
+
+// updateRevision increments the revision of the flow, if the current call has succeeded, or it has changed the flow before failing.
+func (f *Flow) updateRevision(succeeded bool) {
+	if succeeded || f.journaling.changed {
+		f.revision++
 	}
+}
 
+// handleAction handles a single action at the given time, without following the automatic transitions.
+// It reports whether an automatic transition is pending afterwards.
+func (f *Flow) handleAction(ctx context.Context, a Action, now time.Time) (bool, error) {
 	actionType := a.Type()
-	stateConfig, ok := f.states[f.currentState]
-	if !ok {
-		return fmt.Errorf("illegal state: %s", f.currentState)
+	c := cause{action: actionType, from: f.currentState, at: now}
+	if err := f.checkAccepting(actionType); err != nil {
+		return false, f.recordError(c, err)
 	}
-	actionHandler := stateConfig.Handler
-
-	if actionHandler == nil {
-		if f.defaultHandler == nil {
-			return fmt.Errorf("no handler for state: %s and no default handler found. Did you forget to set one of them?", f.currentState)
+	if f.childRunning() {
+		handled, pending, err := f.handleChildAction(ctx, a, now)
+		if handled || err != nil {
+			return pending, err
+		}
+	}
+	if f.inParallelState() {
+		handled, pending, err := f.handleRegionAction(ctx, a, now)
+		if handled || err != nil {
+			return pending, err
 		}
-		actionHandler = f.defaultHandler
+	}
+	actionHandler := f.resolveHandler(f.currentState)
+	if actionHandler == nil {
+		return false, f.recordError(c, f.noHandlerError())
 	}
 	f.logf("Incoming action: %s\n", actionType)
 	inputEvent, nextData, err := actionHandler(ctx, f.data, a)
 	if err != nil {
 		f.logf("Error: %v\n", err)
-		return err
+		return false, f.recordError(c, err)
 	}
-	var nextState State
 	if inputEvent == NoEvent {
 		f.logf("<Action>%s -> No event\n", actionType)
-		nextState = f.currentState
-	} else {
-		nextState, ok = stateConfig.Transitions[inputEvent]
-		if !ok {
-			return fmt.Errorf("no transition found for event: %s", inputEvent)
-		}
-		f.logf("<Action>%s -> <Event>%s\n", actionType, inputEvent)
-
-		err := f.runPreTransitionHooks(ctx, nextData, nextState)
-		if err != nil {
-			return err
-		}
-		f.logf("Transition: %s -> %s\n", f.currentState, nextState)
+		f.setData(nextData)
+		f.record(c, f.currentState, nil)
+		f.runPostTransitionHooks(ctx, nextData, f.currentState)
+		return f.afterTransition(ctx, f.currentState), nil
+	}
+	c.event = inputEvent
+	nextState, err := f.resolveTransition(ctx, f.currentState, inputEvent, nextData)
+	if err != nil {
+		f.logf("Error: %v\n", err)
+		return false, f.recordError(c, err)
 	}
+	f.logf("<Action>%s -> <Event>%s\n", actionType, inputEvent)
+	return f.transition(ctx, c, nextData, nextState)
+}
 
-	f.data = nextData
-	f.currentState = nextState
-	f.runPostTransitionHooks(ctx, nextData, nextState)
+// checkAccepting returns an error, if the flow does not accept any action in its current condition.
+func (f *Flow) checkAccepting(actionType ActionType) error {
+	if f.compensating {
+		return errors.B().
+			Code(ErrCompensating).
+			Op("flow.HandleAction").
+			Msgf("flow is compensating, action %s is not accepted", actionType).Build()
+	}
+	if f.completed {
+		return errors.B().
+			Code(ErrFlowCompleted).
+			Op("flow.HandleAction").
+			Msg("flow is completed").Build()
+	}
+	if f.isExpired() {
+		return expiredError("flow.HandleAction")
+	}
+	if _, ok := f.states[f.currentState]; !ok {
+		return errors.B().
+			Code(ErrIllegalState).
+			Op("flow.HandleAction").
+			Msgf("illegal state: %s", f.currentState).Build()
+	}
+	return nil
+}
 
-	if nextStateConfig, ok := f.states[nextState]; ok {
-		if nextStateConfig.Final {
-			f.completed = true
-			f.runCompletionHooks(ctx, nextData)
-			f.logf("Flow completed\n")
+func (f *Flow) noHandlerError() error {
+	return errors.B().
+		Code(ErrNoHandler).
+		Op("flow.HandleAction").
+		Msgf("no handler for state: %s and no default handler found. Did you forget to set one of them?", f.currentState).Build()
+}
+
+func expiredError(op string) error {
+	return errors.B().
+		Code(ErrFlowExpired).
+		Op(op).
+		Msg("flow expired").Build()
+}
+
+// runAutomaticTransitions follows the automatic transitions of autopass states and completed parallel states,
+// one after another, as long as they are pending. The length of such a chain is limited by the maximum autopass chain,
+// so a cycle of autopass states cannot run forever. When the limit is reached, the flow remains in the last state it has reached.
+// The states entered by the chain start their timers at the given time.
+func (f *Flow) runAutomaticTransitions(ctx context.Context, pending bool, err error, now time.Time) error {
+	limit := f.autopassLimit()
+	for chain := 0; pending && err == nil; chain++ {
+		if chain >= limit {
+			return errors.B().
+				Code(ErrAutopassLimitExceeded).
+				Op("flow.HandleAction").
+				Msgf("more than %d automatic transitions in a row, stopped in state: %s", limit, f.currentState).Build()
 		}
+		if f.inParallelState() && f.regionsDone() {
+			pending, err = f.joinRegions(ctx, now)
+			continue
+		}
+		pending, err = f.handleAction(ctx, autopassAction{}, now)
 	}
+	return err
+}
 
-	if nextStateConfig, ok := f.states[nextState]; ok && nextStateConfig.Autopass {
-		f.logf("Reached an autopass state: %s\n", nextState)
-		return f.HandleAction(ctx, autopassAction{})
+// transition moves the flow to the next state, and runs the hooks around it.
+// If an exit action, a pre-transition hook or an entry action fails, the flow remains in the same state.
+// The transition is recorded in the history with its cause, and the timers of the entered states start at the time of the cause.
+// It reports whether an automatic transition is pending afterwards.
+func (f *Flow) transition(ctx context.Context, c cause, data FlowData, nextState State) (bool, error) {
+	if err := f.runTransitionHooks(ctx, data, f.currentState, nextState); err != nil {
+		return false, f.recordError(c, err)
+	}
+	f.logf("Transition: %s -> %s\n", f.currentState, nextState)
+	exited, entered := f.transitionScope(f.currentState, nextState)
+	f.setData(data)
+	f.enterState(nextState, c.at)
+	f.updateDeadlines(exited, entered, c.at)
+	f.updateChild(exited, entered)
+	f.recordCompensations(exited)
+	f.record(c, nextState, nil)
+	f.journaling.step("", c, nextState, f.enteredAt)
+	f.runPostTransitionHooks(ctx, data, nextState)
+	return f.afterTransition(ctx, nextState), nil
+}
+
+// afterTransition completes the flow if it reached a final state,
+// and reports whether an automatic transition is pending.
+func (f *Flow) afterTransition(ctx context.Context, state State) bool {
+	nextStateConfig, ok := f.states[state]
+	if !ok {
+		return false
+	}
+	if nextStateConfig.Final {
+		f.completed = true
+		f.deadlines = nil
+		f.runCompletionHooks(ctx, f.data)
+		f.logf("Flow completed\n")
+		return false
+	}
+	if f.inParallelState() {
+		return f.hasPendingRegions()
+	}
+	if nextStateConfig.Autopass {
+		f.logf("Reached an autopass state: %s\n", state)
+		return true
+	}
+	return false
+}
+
+// resolveTransition finds the next state for an event in the given state.
+// The transitions are resolved from the state outward to its ancestors, and the first match is taken.
+// If none of them matches, the global transitions of [AnyState] are consulted.
+// Guarded transitions are evaluated against the data returned by the action handler.
+// If the target is a compound state, the flow enters its initial leaf state.
+func (f *Flow) resolveTransition(ctx context.Context, state State, event Event, data FlowData) (State, error) {
+	guarded := false
+	path := f.states.transitionPath(state)
+	for i := len(path) - 1; i >= 0; i-- {
+		stateConfig := f.states[path[i]]
+		if candidates, ok := stateConfig.GuardedTransitions[event]; ok {
+			nextState, ok, err := evaluateGuards(ctx, event, candidates, data)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				return f.states.InitialLeaf(nextState), nil
+			}
+			guarded = true
+			continue
+		}
+		if nextState, ok := stateConfig.Transitions[event]; ok {
+			return f.states.InitialLeaf(nextState), nil
+		}
+	}
+	if guarded {
+		return "", errors.B().
+			Code(ErrNoPassingGuard).
+			Op("flow.HandleAction").
+			Msgf("no guard passed for event: %s in state: %s", event, state).Build()
+	}
+	return "", errors.B().
+		Code(ErrNoTransition).
+		Op("flow.HandleAction").
+		Msgf("no transition found for event: %s in state: %s", event, state).Build()
+}
+
+// runTransitionHooks runs the hooks, which can abort a transition, in the following order:
+// the exit actions of the exited states, the pre-transition hooks of the next state,
+// and the entry actions of the entered states.
+func (f *Flow) runTransitionHooks(ctx context.Context, data FlowData, from State, to State) error {
+	exited, entered := f.transitionScope(from, to)
+	for _, state := range exited {
+		if onExit := f.states[state].OnExit; onExit != nil {
+			f.logf("Calling exit action for state: %s\n", state)
+			if err := callHook(ctx, fmt.Sprintf("exit action of %s", state), onExit, data); err != nil {
+				f.logf("Error during exit action: %v\n", err)
+				return err
+			}
+		}
+	}
+	if err := f.runPreTransitionHooks(ctx, data, to); err != nil {
+		return err
+	}
+	for _, state := range entered {
+		if onEntry := f.states[state].OnEntry; onEntry != nil {
+			f.logf("Calling entry action for state: %s\n", state)
+			if err := callHook(ctx, fmt.Sprintf("entry action of %s", state), onEntry, data); err != nil {
+				f.logf("Error during entry action: %v\n", err)
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -218,7 +542,7 @@ func (f *Flow) runPreTransitionHooks(ctx context.Context, data FlowData, nextSta
 	hook := f.composePreTransitionHooks(nextState)
 	if hook != nil {
 		f.logf("Calling pre-transition hook for state: %s\n", nextState)
-		if err := hook(ctx, data); err != nil {
+		if err := callHook(ctx, "pre-transition hook", hook, data); err != nil {
 			f.logf("Error during pre-transition hook: %v\n", err)
 			return err
 		}
@@ -226,7 +550,7 @@ func (f *Flow) runPreTransitionHooks(ctx context.Context, data FlowData, nextSta
 	registryHook := globalHookRegistry.composePreTransitions(f.flowType, nextState)
 	if registryHook != nil {
 		f.logf("Calling pre-transition hook from global registry for state: %s\n", nextState)
-		if err := registryHook(ctx, data); err != nil {
+		if err := callHook(ctx, "pre-transition hook", registryHook, data); err != nil {
 			f.logf("Error during pre-transition hook from registry: %v\n", err)
 			return err
 		}
@@ -235,28 +559,24 @@ func (f *Flow) runPreTransitionHooks(ctx context.Context, data FlowData, nextSta
 }
 
 func (f *Flow) runPostTransitionHooks(ctx context.Context, data FlowData, nextState State) {
-	hook := f.composePostTransitionHooks(nextState)
-	if hook != nil {
+	for _, hook := range f.postHookTable[nextState] {
 		f.logf("Calling post-transition hook for state: %s\n", nextState)
-		hook(ctx, data)
+		f.callSilentHook(ctx, "post-transition hook", hook, data)
 	}
-	registryHook := globalHookRegistry.composePostTransitionHooks(f.flowType, nextState)
-	if registryHook != nil {
+	for _, hook := range globalHookRegistry.postTransitionHookList(f.flowType, nextState) {
 		f.logf("Calling post-transition hook from global registry for state: %s\n", nextState)
-		registryHook(ctx, data)
+		f.callSilentHook(ctx, "post-transition hook", hook, data)
 	}
 }
 
 func (f *Flow) runCompletionHooks(ctx context.Context, data FlowData) {
-	hook := f.composeCompletionHooks()
-	if hook != nil {
+	for _, hook := range f.completionHooks {
 		f.logf("Calling completion hook\n")
-		hook(ctx, data)
+		f.callSilentHook(ctx, "completion hook", hook, data)
 	}
-	registryHook := globalHookRegistry.composeCompletionHooks(f.flowType)
-	if registryHook != nil {
+	for _, hook := range globalHookRegistry.completionHookList(f.flowType) {
 		f.logf("Calling completion hook from global registry\n")
-		registryHook(ctx, data)
+		f.callSilentHook(ctx, "completion hook", hook, data)
 	}
 }
 
@@ -268,34 +588,77 @@ func New(opts CreateFlowOpts) *Flow {
 	if opts.InitialState == "" {
 		panic("InitialState cannot be empty")
 	}
+	if opts.Strict {
+		report := Validate(opts.TransitionTable, opts.InitialState)
+		if opts.Handler != nil {
+			report = report.without(IssueMissingHandler)
+		}
+		if err := report.Err(); err != nil {
+			panic(err)
+		}
+	}
 	logf("Creating a new Flow(%s), ID=%s\n", opts.Type, opts.ID)
+	now := time.Now()
 	if opts.ExpireIn > 0 {
-		opts.ExpireAt = time.Now().Add(opts.ExpireIn)
+		opts.ExpireAt = now.Add(opts.ExpireIn)
 	}
 
-	return &Flow{
-		id:             opts.ID,
-		flowType:       opts.Type,
-		data:           opts.Data,
-		currentState:   opts.InitialState,
-		states:         opts.TransitionTable,
-		defaultHandler: opts.Handler,
-		expiresAt:      opts.ExpireAt,
+	f := &Flow{
+		id:               opts.ID,
+		flowType:         opts.Type,
+		data:             opts.Data,
+		states:           opts.TransitionTable,
+		defaultHandler:   opts.Handler,
+		middlewares:      opts.Middlewares,
+		onHookPanic:      opts.OnHookPanic,
+		expiresAt:        opts.ExpireAt,
+		expirationEvent:  opts.ExpirationEvent,
+		expirationState:  opts.ExpirationState,
+		maxAutopass:      opts.MaxAutopassChain,
+		historyPolicy:    opts.History,
+		compensatedState: opts.CompensatedState,
+		version:          opts.Version,
 	}
+	f.enterState(opts.TransitionTable.InitialLeaf(opts.InitialState), now)
+	f.updateDeadlines(nil, f.activeStateSet(), now)
+	f.updateChild(nil, f.activeStateSet())
+	return f
 }
 
 // ToSnapshot converts the flow to a Snapshot to be persisted.
 func (f *Flow) ToSnapshot() (*Snapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.toSnapshot()
+}
+
+func (f *Flow) toSnapshot() (*Snapshot, error) {
 	dataJson, err := json.Marshal(f.data)
 	if err != nil {
 		return nil, err
 	}
+	var child *Snapshot
+	if f.child != nil {
+		if child, err = f.child.ToSnapshot(); err != nil {
+			return nil, err
+		}
+	}
 	return &Snapshot{
-		ID:           f.id,
-		Type:         string(f.flowType),
-		Data:         f.data,
-		EncodedData:  dataJson,
-		CurrentState: f.currentState,
+		ID:            f.id,
+		Type:          string(f.flowType),
+		Data:          f.data,
+		EncodedData:   dataJson,
+		CurrentState:  f.currentState,
+		Regions:       f.copyRegions(),
+		EnteredAt:     f.enteredAt,
+		Deadlines:     f.copyDeadlines(),
+		History:       f.copyHistory(),
+		Compensations: f.copyCompensations(),
+		Compensating:  f.compensating,
+		Child:         child,
+		Revision:      f.revision,
+		Version:       f.version,
+		JournalSeq:    f.journaling.seq,
 		ExpiresAt: sql.NullTime{
 			Time:  f.expiresAt,
 			Valid: !f.expiresAt.IsZero(),
@@ -306,26 +669,68 @@ func (f *Flow) ToSnapshot() (*Snapshot, error) {
 
 func HydrateSnapShot(ctx context.Context, s *Snapshot, stateMap TransitionTable) (*Flow, error) {
 	f := FromSnapshot(s, stateMap)
-	hydrationFn := HookRegistry().composeHydrationHooks(f.flowType)
-	if hydrationFn != nil {
-		var err error
-		if f.data, err = hydrationFn(ctx, f.data); err != nil {
-			return nil, err
-		}
+	if err := f.hydrate(ctx); err != nil {
+		return nil, err
 	}
 	return f, nil
 }
 
+// hydrate runs the hydration hooks of the global registry on the data of the flow.
+func (f *Flow) hydrate(ctx context.Context) error {
+	if f.child != nil {
+		if err := f.child.hydrate(ctx); err != nil {
+			return err
+		}
+	}
+	hydrationFn := HookRegistry().composeHydrationHooks(f.flowType)
+	if hydrationFn == nil {
+		return nil
+	}
+	data, err := callHydrationHook(ctx, hydrationFn, f.data)
+	if err != nil {
+		return err
+	}
+	f.data = data
+	return nil
+}
+
+// setData replaces the data of the flow after an action or a transition.
+func (f *Flow) setData(data FlowData) {
+	f.data = data
+	f.journaling.changed = true
+}
+
 // FromSnapshot restores a flow from a Snapshot.
+// The snapshot is not migrated, so it must have the version of the TransitionTable.
+// Use [Definition.Restore] to restore the snapshots of previous versions.
 func FromSnapshot(s *Snapshot, stateMap TransitionTable) *Flow {
 	flow := Flow{
-		id:           s.ID,
-		flowType:     FlowType(s.Type),
-		data:         s.Data,
-		currentState: s.CurrentState,
-		states:       stateMap,
-		completed:    s.IsCompleted,
+		id:            s.ID,
+		flowType:      FlowType(s.Type),
+		data:          s.Data,
+		states:        stateMap,
+		completed:     s.IsCompleted,
+		revision:      s.Revision,
+		version:       s.Version,
+		history:       append([]HistoryEntry(nil), s.History...),
+		compensations: append([]State(nil), s.Compensations...),
+		compensating:  s.Compensating,
+	}
+	flow.journaling.seq = s.JournalSeq
+	flow.enterState(stateMap.InitialLeaf(s.CurrentState), s.EnteredAt)
+	if len(s.Regions) > 0 && flow.inParallelState() {
+		for region, state := range s.Regions {
+			flow.regions[region] = state
+		}
 	}
+	if s.EnteredAt.IsZero() {
+		// The snapshot was taken before timers were recorded, so the timers are started now.
+		flow.enteredAt = time.Now()
+		flow.updateDeadlines(nil, flow.activeStateSet(), flow.enteredAt)
+	} else {
+		flow.deadlines = append([]Deadline(nil), s.Deadlines...)
+	}
+	flow.restoreChild(s.Child)
 	if s.ExpiresAt.Valid {
 		flow.expiresAt = s.ExpiresAt.Time
 	}
@@ -336,10 +741,28 @@ func FromSnapshot(s *Snapshot, stateMap TransitionTable) *Flow {
 // If a state does not have a handler, the default handler will be used.
 // This is useful when you want to have a central place to handle all actions.
 func (f *Flow) WithDefaultActionHandler(handler ActionHandler) *Flow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.defaultHandler = handler
 	return f
 }
 
+// WithMaxAutopassChain sets the maximum number of automatic transitions following an action.
+// This is useful for flows restored from a snapshot, see [CreateFlowOpts.MaxAutopassChain].
+func (f *Flow) WithMaxAutopassChain(max int) *Flow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.maxAutopass = max
+	return f
+}
+
+func (f *Flow) autopassLimit() int {
+	if f.maxAutopass <= 0 {
+		return DefaultMaxAutopassChain
+	}
+	return f.maxAutopass
+}
+
 func (f *Flow) ID() string {
 	return f.id
 }
@@ -348,11 +771,53 @@ func (f *Flow) Type() FlowType {
 	return f.flowType
 }
 
+// CurrentState returns the innermost active state of the flow.
 func (f *Flow) CurrentState() State {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	return f.currentState
 }
 
+// CurrentStatePath returns the full active path of the flow,
+// from the outermost active state down to the current state.
+func (f *Flow) CurrentStatePath() []State {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.states.Path(f.currentState)
+}
+
+// ActiveStates returns the innermost active states of the flow.
+// When the flow is in a parallel state, it contains the active state of every region.
+// Otherwise, it only contains the current state.
+func (f *Flow) ActiveStates() []State {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.activeStates()
+}
+
+func (f *Flow) activeStates() []State {
+	if !f.inParallelState() {
+		return []State{f.currentState}
+	}
+	regions := f.states[f.currentState].Regions
+	states := make([]State, 0, len(regions))
+	for _, region := range regions {
+		states = append(states, f.regions[region])
+	}
+	return states
+}
+
+// Revision returns the number of actions, which the flow has handled successfully or which have changed it before failing,
+// e.g. by adding the failure to its history. Ticks firing timers are counted as well. A flow must be saved, whenever its revision has changed, see [Flow.HandleAction].
+func (f *Flow) Revision() uint64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.revision
+}
+
 func (f *Flow) Data() FlowData {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	return f.data
 }
 
@@ -361,22 +826,40 @@ func (f *Flow) TransitionTable() TransitionTable {
 }
 
 func (f *Flow) IsCompleted() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	return f.completed
 }
 
 func (f *Flow) IsExpired() bool {
-	return !f.expiresAt.IsZero() && time.Now().After(f.expiresAt)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.isExpired()
+}
+
+func (f *Flow) isExpired() bool {
+	return f.isExpiredAt(time.Now())
+}
+
+func (f *Flow) isExpiredAt(now time.Time) bool {
+	return !f.expiresAt.IsZero() && now.After(f.expiresAt)
 }
 
 func (f *Flow) ExpiresAt() time.Time {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
 	return f.expiresAt
 }
 
 func (f *Flow) SetExpirationAt(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.expiresAt = t
 }
 
 func (f *Flow) SetExpirationIn(t time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.expiresAt = time.Now().Add(t)
 }
 
@@ -0,0 +1,102 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/necrobits/x/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutopassChain(t *testing.T) {
+	ctx := context.Background()
+	chainTable := func(length int) TransitionTable {
+		table := TransitionTable{
+			"Start": StateConfig{
+				Handler:     emit("Next"),
+				Transitions: Transitions{"Next": "Step0"},
+			},
+			"Done": StateConfig{Final: true},
+		}
+		for i := 0; i < length; i++ {
+			next := State(fmt.Sprintf("Step%d", i+1))
+			if i == length-1 {
+				next = "Done"
+			}
+			table[State(fmt.Sprintf("Step%d", i))] = StateConfig{
+				Handler:     emit("Next"),
+				Autopass:    true,
+				Transitions: Transitions{"Next": next},
+			}
+		}
+		return table
+	}
+
+	t.Run("LongChain", func(t *testing.T) {
+		f := New(CreateFlowOpts{
+			ID:               "1",
+			InitialState:     "Start",
+			TransitionTable:  chainTable(10000),
+			MaxAutopassChain: 10000,
+		})
+		require.NoError(t, f.HandleAction(ctx, testAction{"Go"}))
+		require.Equal(t, State("Done"), f.CurrentState())
+	})
+
+	t.Run("LimitExceeded", func(t *testing.T) {
+		f := New(CreateFlowOpts{
+			ID:               "1",
+			InitialState:     "Start",
+			TransitionTable:  chainTable(10),
+			MaxAutopassChain: 5,
+		})
+		err := f.HandleAction(ctx, testAction{"Go"})
+		require.True(t, errors.Is(err, ErrAutopassLimitExceeded))
+		require.Equal(t, State("Step5"), f.CurrentState())
+		require.False(t, f.IsCompleted())
+		require.Equal(t, uint64(1), f.Revision())
+	})
+
+	t.Run("Cycle", func(t *testing.T) {
+		table := TransitionTable{
+			"Start": StateConfig{Handler: emit("Next"), Transitions: Transitions{"Next": "A"}},
+			"A":     StateConfig{Handler: emit("Next"), Autopass: true, Transitions: Transitions{"Next": "B"}},
+			"B":     StateConfig{Handler: emit("Next"), Autopass: true, Transitions: Transitions{"Next": "A"}},
+		}
+		f := New(CreateFlowOpts{ID: "1", InitialState: "Start", TransitionTable: table})
+		err := f.HandleAction(ctx, testAction{"Go"})
+		require.True(t, errors.Is(err, ErrAutopassLimitExceeded))
+		require.Contains(t, []State{"A", "B"}, f.CurrentState())
+	})
+}
+
+func TestRevision(t *testing.T) {
+	ctx := context.Background()
+	table := TransitionTable{
+		"Start": StateConfig{
+			Handler: func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+				if a.Type() == "Fail" {
+					return NoEvent, data, fmt.Errorf("failed")
+				}
+				return NoEvent, data, nil
+			},
+			After:       []Timer{{Delay: time.Minute, Event: "Timeout"}},
+			Transitions: Transitions{"Timeout": "Done"},
+		},
+		"Done": StateConfig{Final: true},
+	}
+	f := New(CreateFlowOpts{ID: "1", InitialState: "Start", TransitionTable: table})
+	require.NoError(t, f.HandleAction(ctx, testAction{"Go"}))
+	require.Error(t, f.HandleAction(ctx, testAction{"Fail"}))
+	require.Equal(t, uint64(1), f.Revision())
+	require.NoError(t, f.Tick(ctx, time.Now()))
+	require.Equal(t, uint64(1), f.Revision())
+	require.NoError(t, f.Tick(ctx, time.Now().Add(2*time.Minute)))
+	require.Equal(t, uint64(2), f.Revision())
+
+	snapshot, err := f.ToSnapshot()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), FromSnapshot(snapshot, table).Revision())
+}
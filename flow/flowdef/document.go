@@ -0,0 +1,413 @@
+// Package flowdef loads flow definitions from YAML or JSON documents, and exports them back.
+// The structure of a flow is described by the document, while the Go functions, e.g. the action handlers,
+// are referenced by name and bound from a Registry. For example:
+//
+//	type: Order
+//	initial_state: AwaitingPayment
+//	expire_in: 24h
+//	states:
+//	  AwaitingPayment:
+//	    handler: payment
+//	    actions: [Pay, Cancel]
+//	    after:
+//	      - delay: 15m
+//	        event: PaymentTimedOut
+//	    transitions:
+//	      Paid: Shipping
+//	      PaymentTimedOut: Canceled
+//	  Shipping:
+//	    handler: shipping
+//	    on_entry: bookShipment
+//	    transitions:
+//	      Shipped: Delivered
+//	  Delivered:
+//	    final: true
+//	  Canceled:
+//	    final: true
+//
+// Sub-flows are not supported, since their definitions cannot be referenced by name.
+package flowdef
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ErrUnknownName is returned when a document references a function, which is not registered.
+	ErrUnknownName = "unknown_name"
+	// ErrUnnamedFunction is returned when a definition is exported, but one of its functions is not registered.
+	ErrUnnamedFunction = "unnamed_function"
+	// ErrInvalidDocument is returned when a document cannot be decoded, or it does not describe a valid flow.
+	ErrInvalidDocument = "invalid_document"
+)
+
+// Format is the encoding of a document.
+type Format string
+
+const (
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+)
+
+// Document is the declarative description of a flow.Definition.
+// The migrations and the middlewares of a definition are not part of the document, they have to be added in Go,
+// see flow.Migration and flow.Middleware.
+// Durations are written like "15m" or "1h30m", see time.ParseDuration.
+type Document struct {
+	Type             flow.FlowType            `json:"type" yaml:"type"`
+	InitialState     flow.State               `json:"initial_state" yaml:"initial_state"`
+	Version          int                      `json:"version,omitempty" yaml:"version,omitempty"`
+	Handler          string                   `json:"handler,omitempty" yaml:"handler,omitempty"`
+	ExpireIn         string                   `json:"expire_in,omitempty" yaml:"expire_in,omitempty"`
+	ExpirationEvent  flow.Event               `json:"expiration_event,omitempty" yaml:"expiration_event,omitempty"`
+	ExpirationState  flow.State               `json:"expiration_state,omitempty" yaml:"expiration_state,omitempty"`
+	MaxAutopassChain int                      `json:"max_autopass_chain,omitempty" yaml:"max_autopass_chain,omitempty"`
+	CompensatedState flow.State               `json:"compensated_state,omitempty" yaml:"compensated_state,omitempty"`
+	States           map[flow.State]StateSpec `json:"states" yaml:"states"`
+}
+
+// StateSpec is the declarative description of a flow.StateConfig.
+// Handler, Guard, OnEntry, OnExit and Compensate are the names of registered functions.
+// The global transitions are described by the state flow.AnyState, i.e. "*".
+type StateSpec struct {
+	Handler            string                       `json:"handler,omitempty" yaml:"handler,omitempty"`
+	Actions            []flow.ActionType            `json:"actions,omitempty" yaml:"actions,omitempty"`
+	Transitions        map[flow.Event]flow.State    `json:"transitions,omitempty" yaml:"transitions,omitempty"`
+	GuardedTransitions map[flow.Event][]GuardedSpec `json:"guarded_transitions,omitempty" yaml:"guarded_transitions,omitempty"`
+	Final              bool                         `json:"final,omitempty" yaml:"final,omitempty"`
+	Autopass           bool                         `json:"autopass,omitempty" yaml:"autopass,omitempty"`
+	Parent             flow.State                   `json:"parent,omitempty" yaml:"parent,omitempty"`
+	Initial            flow.State                   `json:"initial,omitempty" yaml:"initial,omitempty"`
+	Regions            []flow.State                 `json:"regions,omitempty" yaml:"regions,omitempty"`
+	DoneEvent          flow.Event                   `json:"done_event,omitempty" yaml:"done_event,omitempty"`
+	After              []TimerSpec                  `json:"after,omitempty" yaml:"after,omitempty"`
+	OnEntry            string                       `json:"on_entry,omitempty" yaml:"on_entry,omitempty"`
+	OnExit             string                       `json:"on_exit,omitempty" yaml:"on_exit,omitempty"`
+	Compensate         string                       `json:"compensate,omitempty" yaml:"compensate,omitempty"`
+	Except             []flow.State                 `json:"except,omitempty" yaml:"except,omitempty"`
+}
+
+// GuardedSpec is the declarative description of a flow.GuardedTarget. Without a guard, the candidate always passes.
+type GuardedSpec struct {
+	Target flow.State `json:"target" yaml:"target"`
+	Guard  string     `json:"guard,omitempty" yaml:"guard,omitempty"`
+	Name   string     `json:"name,omitempty" yaml:"name,omitempty"`
+}
+
+// TimerSpec is the declarative description of a flow.Timer.
+type TimerSpec struct {
+	Delay string     `json:"delay" yaml:"delay"`
+	Event flow.Event `json:"event" yaml:"event"`
+}
+
+// Load reads a document, and builds the definition it describes.
+func Load(r io.Reader, format Format, registry *Registry) (*flow.Definition, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := Decode(raw, format)
+	if err != nil {
+		return nil, err
+	}
+	return doc.Build(registry)
+}
+
+// LoadFile reads a document from a file, and builds the definition it describes.
+// The format is derived from the extension of the file: .yaml, .yml or .json.
+func LoadFile(path string, registry *Registry) (*flow.Definition, error) {
+	format, err := formatOf(path)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Load(file, format, registry)
+}
+
+// Export writes the document describing a definition.
+func Export(w io.Writer, def *flow.Definition, format Format, registry *Registry) error {
+	doc, err := NewDocument(def, registry)
+	if err != nil {
+		return err
+	}
+	encoded, err := doc.Encode(format)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encoded)
+	return err
+}
+
+func formatOf(path string) (Format, error) {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return FormatYAML, nil
+	case ".json":
+		return FormatJSON, nil
+	}
+	return "", errors.B().
+		Code(ErrInvalidDocument).
+		Op("flowdef.LoadFile").
+		Msgf("unknown format of file: %s", path).Build()
+}
+
+// Decode decodes a document. Unknown fields are rejected, so typos do not go unnoticed.
+func Decode(raw []byte, format Format) (*Document, error) {
+	doc := &Document{}
+	var err error
+	switch format {
+	case FormatYAML:
+		decoder := yaml.NewDecoder(bytes.NewReader(raw))
+		decoder.KnownFields(true)
+		err = decoder.Decode(doc)
+	case FormatJSON:
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(doc)
+	default:
+		return nil, fmt.Errorf("unknown format: %s", format)
+	}
+	if err != nil {
+		return nil, errors.B().
+			Code(ErrInvalidDocument).
+			Op("flowdef.Decode").
+			Msgf("cannot decode %s document: %v", format, err).Build()
+	}
+	return doc, nil
+}
+
+// Encode encodes the document.
+func (d *Document) Encode(format Format) ([]byte, error) {
+	switch format {
+	case FormatYAML:
+		var buffer bytes.Buffer
+		encoder := yaml.NewEncoder(&buffer)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(d); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case FormatJSON:
+		return json.MarshalIndent(d, "", "  ")
+	}
+	return nil, fmt.Errorf("unknown format: %s", format)
+}
+
+// Build builds the definition described by the document, binding the functions from the registry.
+// The transition table is validated using flow.Validate. States without a handler are accepted, if the document has a default handler.
+func (d *Document) Build(registry *Registry) (*flow.Definition, error) {
+	def := &flow.Definition{
+		Type:             d.Type,
+		InitialState:     d.InitialState,
+		Version:          d.Version,
+		MaxAutopassChain: d.MaxAutopassChain,
+		CompensatedState: d.CompensatedState,
+		ExpirationEvent:  d.ExpirationEvent,
+		ExpirationState:  d.ExpirationState,
+		TransitionTable:  make(flow.TransitionTable, len(d.States)),
+	}
+	var err error
+	if def.Handler, err = registry.handler(d.Handler); err != nil {
+		return nil, err
+	}
+	if def.ExpireIn, err = parseDuration(d.ExpireIn, "expire_in"); err != nil {
+		return nil, err
+	}
+	for state, spec := range d.States {
+		if def.TransitionTable[state], err = spec.build(state, registry); err != nil {
+			return nil, err
+		}
+	}
+	// The compensated and the expiration state are only entered by flow.Flow.Compensate and flow.Flow.Expire,
+	// so they are not reachable by a transition.
+	report := withoutIssues(flow.Validate(def.TransitionTable, def.InitialState), func(issue flow.ValidationIssue) bool {
+		return issue.Type == flow.IssueUnreachableState && (issue.State == def.CompensatedState || issue.State == def.ExpirationState) ||
+			issue.Type == flow.IssueMissingHandler && def.Handler != nil
+	})
+	if err := report.Err(); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+func withoutIssues(report *flow.ValidationReport, ignore func(issue flow.ValidationIssue) bool) *flow.ValidationReport {
+	filtered := &flow.ValidationReport{}
+	for _, issue := range report.Issues {
+		if !ignore(issue) {
+			filtered.Issues = append(filtered.Issues, issue)
+		}
+	}
+	return filtered
+}
+
+func (s StateSpec) build(state flow.State, registry *Registry) (flow.StateConfig, error) {
+	config := flow.StateConfig{
+		Actions:     s.Actions,
+		Transitions: s.Transitions,
+		Final:       s.Final,
+		Autopass:    s.Autopass,
+		Parent:      s.Parent,
+		Initial:     s.Initial,
+		Regions:     s.Regions,
+		DoneEvent:   s.DoneEvent,
+		Except:      s.Except,
+	}
+	var err error
+	if config.Handler, err = registry.handler(s.Handler); err != nil {
+		return config, err
+	}
+	if config.OnEntry, err = registry.hook(s.OnEntry); err != nil {
+		return config, err
+	}
+	if config.OnExit, err = registry.hook(s.OnExit); err != nil {
+		return config, err
+	}
+	if config.Compensate, err = registry.compensation(s.Compensate); err != nil {
+		return config, err
+	}
+	if len(s.GuardedTransitions) > 0 {
+		config.GuardedTransitions = make(flow.GuardedTransitions, len(s.GuardedTransitions))
+	}
+	for event, candidates := range s.GuardedTransitions {
+		targets := make([]flow.GuardedTarget, 0, len(candidates))
+		for _, candidate := range candidates {
+			guard, err := registry.guard(candidate.Guard)
+			if err != nil {
+				return config, err
+			}
+			targets = append(targets, flow.GuardedTarget{Target: candidate.Target, Guard: guard, Name: candidate.Name})
+		}
+		config.GuardedTransitions[event] = targets
+	}
+	for _, timer := range s.After {
+		delay, err := parseDuration(timer.Delay, fmt.Sprintf("delay of timer %s in state %s", timer.Event, state))
+		if err != nil {
+			return config, err
+		}
+		config.After = append(config.After, flow.Timer{Delay: delay, Event: timer.Event})
+	}
+	return config, nil
+}
+
+func parseDuration(value string, field string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.B().
+			Code(ErrInvalidDocument).
+			Op("flowdef.Load").
+			Msgf("invalid %s: %v", field, err).Build()
+	}
+	return duration, nil
+}
+
+// formatDuration formats a duration like time.Duration.String, but without the trailing zero units, e.g. "1h30m".
+func formatDuration(d time.Duration) string {
+	formatted := d.String()
+	if strings.HasSuffix(formatted, "m0s") {
+		formatted = strings.TrimSuffix(formatted, "0s")
+	}
+	if strings.HasSuffix(formatted, "h0m") {
+		formatted = strings.TrimSuffix(formatted, "0m")
+	}
+	return formatted
+}
+
+// NewDocument creates the document describing a definition. Every function of the definition must be registered.
+// Sub-flows cannot be described, so a definition with a state invoking one is rejected.
+func NewDocument(def *flow.Definition, registry *Registry) (*Document, error) {
+	doc := &Document{
+		Type:             def.Type,
+		InitialState:     def.InitialState,
+		Version:          def.Version,
+		MaxAutopassChain: def.MaxAutopassChain,
+		CompensatedState: def.CompensatedState,
+		ExpirationEvent:  def.ExpirationEvent,
+		ExpirationState:  def.ExpirationState,
+		States:           make(map[flow.State]StateSpec, len(def.TransitionTable)),
+	}
+	var err error
+	if doc.Handler, err = nameOf(registry.handlers, "default handler", def.Handler); err != nil {
+		return nil, err
+	}
+	if def.ExpireIn > 0 {
+		doc.ExpireIn = formatDuration(def.ExpireIn)
+	}
+	for state, config := range def.TransitionTable {
+		if doc.States[state], err = newStateSpec(state, config, registry); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func newStateSpec(state flow.State, config flow.StateConfig, registry *Registry) (StateSpec, error) {
+	spec := StateSpec{
+		Actions:     config.Actions,
+		Transitions: config.Transitions,
+		Final:       config.Final,
+		Autopass:    config.Autopass,
+		Parent:      config.Parent,
+		Initial:     config.Initial,
+		Regions:     config.Regions,
+		DoneEvent:   config.DoneEvent,
+		Except:      config.Except,
+	}
+	if config.Invoke != nil {
+		return spec, errors.B().
+			Code(ErrUnnamedFunction).
+			Op("flowdef.Export").
+			Msgf("state %s invokes a sub-flow, which cannot be exported", state).Build()
+	}
+	var err error
+	if spec.Handler, err = nameOf(registry.handlers, fmt.Sprintf("handler of state %s", state), config.Handler); err != nil {
+		return spec, err
+	}
+	if spec.OnEntry, err = nameOf(registry.hooks, fmt.Sprintf("entry action of state %s", state), Hook(config.OnEntry)); err != nil {
+		return spec, err
+	}
+	if spec.OnExit, err = nameOf(registry.hooks, fmt.Sprintf("exit action of state %s", state), Hook(config.OnExit)); err != nil {
+		return spec, err
+	}
+	if spec.Compensate, err = nameOf(registry.compensations, fmt.Sprintf("compensation of state %s", state), config.Compensate); err != nil {
+		return spec, err
+	}
+	if len(config.GuardedTransitions) > 0 {
+		spec.GuardedTransitions = make(map[flow.Event][]GuardedSpec, len(config.GuardedTransitions))
+	}
+	for event, targets := range config.GuardedTransitions {
+		candidates := make([]GuardedSpec, 0, len(targets))
+		for i, candidate := range targets {
+			guard, err := nameOf(registry.guards, fmt.Sprintf("guard #%d of event %s in state %s", i+1, event, state), candidate.Guard)
+			if err != nil {
+				return spec, err
+			}
+			candidates = append(candidates, GuardedSpec{Target: candidate.Target, Guard: guard, Name: candidate.Name})
+		}
+		spec.GuardedTransitions[event] = candidates
+	}
+	for _, timer := range config.After {
+		spec.After = append(spec.After, TimerSpec{Delay: formatDuration(timer.Delay), Event: timer.Event})
+	}
+	return spec, nil
+}
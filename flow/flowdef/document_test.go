@@ -0,0 +1,176 @@
+package flowdef
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+	"github.com/stretchr/testify/require"
+)
+
+type orderData struct {
+	Amount  int
+	Shipped bool
+}
+
+type orderAction struct {
+	Kind flow.ActionType
+}
+
+func (a orderAction) Type() flow.ActionType {
+	return a.Kind
+}
+
+const orderDocument = `
+type: Order
+initial_state: AwaitingPayment
+version: 2
+expire_in: 24h
+expiration_state: Canceled
+compensated_state: Refunded
+states:
+  AwaitingPayment:
+    handler: payment
+    actions: [Pay]
+    after:
+      - delay: 15m
+        event: PaymentTimedOut
+    guarded_transitions:
+      Paid:
+        - target: Review
+          guard: isLarge
+          name: large order
+        - target: Shipping
+    transitions:
+      PaymentTimedOut: Canceled
+    compensate: refund
+  Review:
+    handler: approve
+    transitions:
+      Approved: Shipping
+  Shipping:
+    on_entry: bookShipment
+    autopass: true
+    handler: ship
+    transitions:
+      Shipped: Delivered
+  Delivered:
+    final: true
+  Canceled:
+    final: true
+  Refunded:
+    final: true
+  "*":
+    transitions:
+      Canceled: Canceled
+    except: [Shipping]
+`
+
+func orderRegistry(bookings *int) *Registry {
+	return NewRegistry().
+		RegisterHandler("payment", func(ctx context.Context, data flow.FlowData, a flow.Action) (flow.Event, flow.FlowData, error) {
+			return "Paid", data, nil
+		}).
+		RegisterHandler("approve", flow.TypedHandler(func(ctx context.Context, data *orderData, a orderAction) (flow.Event, *orderData, error) {
+			return "Approved", data, nil
+		})).
+		RegisterHandler("ship", flow.TypedHandler(func(ctx context.Context, data *orderData, a flow.Action) (flow.Event, *orderData, error) {
+			return "Shipped", &orderData{Amount: data.Amount, Shipped: true}, nil
+		})).
+		RegisterGuard("isLarge", flow.TypedGuard(func(d *orderData) bool { return d.Amount >= 1000 })).
+		RegisterGuard("isSmall", flow.TypedGuard(func(d *orderData) bool { return d.Amount < 1000 })).
+		RegisterHook("bookShipment", func(ctx context.Context, data flow.FlowData) error {
+			*bookings++
+			return nil
+		}).
+		RegisterCompensation("refund", func(ctx context.Context, data flow.FlowData) (flow.FlowData, error) {
+			return &orderData{}, nil
+		})
+}
+
+func TestLoad(t *testing.T) {
+	ctx := context.Background()
+	bookings := 0
+	def, err := Load(strings.NewReader(orderDocument), FormatYAML, orderRegistry(&bookings))
+	require.NoError(t, err)
+	require.Equal(t, flow.FlowType("Order"), def.Type)
+	require.Equal(t, 24*time.Hour, def.ExpireIn)
+	require.Equal(t, flow.State("Canceled"), def.ExpirationState)
+	require.Equal(t, []flow.Timer{{Delay: 15 * time.Minute, Event: "PaymentTimedOut"}}, def.TransitionTable["AwaitingPayment"].After)
+
+	f := def.New("1", &orderData{Amount: 10})
+	require.False(t, f.ExpiresAt().IsZero())
+	require.Equal(t, []flow.ActionType{"Pay"}, f.AvailableActions())
+	require.NoError(t, f.HandleAction(ctx, orderAction{"Pay"}))
+	require.Equal(t, flow.State("Delivered"), f.CurrentState())
+	require.Equal(t, &orderData{Amount: 10, Shipped: true}, f.Data())
+	require.Equal(t, 1, bookings)
+
+	f = def.New("2", &orderData{Amount: 1000})
+	require.NoError(t, f.HandleAction(ctx, orderAction{"Pay"}))
+	require.Equal(t, flow.State("Review"), f.CurrentState())
+	require.NoError(t, f.Compensate(ctx))
+	require.Equal(t, flow.State("Refunded"), f.CurrentState())
+	require.Equal(t, &orderData{}, f.Data())
+}
+
+func TestLoadErrors(t *testing.T) {
+	registry := orderRegistry(new(int))
+
+	_, err := Load(strings.NewReader(strings.Replace(orderDocument, "handler: ship", "handler: unknown", 1)), FormatYAML, registry)
+	require.True(t, errors.Is(err, ErrUnknownName))
+
+	_, err = Load(strings.NewReader(strings.Replace(orderDocument, "autopass: true", "autopas: true", 1)), FormatYAML, registry)
+	require.True(t, errors.Is(err, ErrInvalidDocument))
+
+	_, err = Load(strings.NewReader(strings.Replace(orderDocument, "delay: 15m", "delay: soon", 1)), FormatYAML, registry)
+	require.True(t, errors.Is(err, ErrInvalidDocument))
+
+	_, err = Load(strings.NewReader(strings.Replace(orderDocument, "Approved: Shipping", "Approved: Unknown", 1)), FormatYAML, registry)
+	require.True(t, errors.Is(err, flow.ErrInvalidTransitionTable))
+}
+
+func TestExport(t *testing.T) {
+	registry := orderRegistry(new(int))
+	def, err := Load(strings.NewReader(orderDocument), FormatYAML, registry)
+	require.NoError(t, err)
+	original, err := Decode([]byte(orderDocument), FormatYAML)
+	require.NoError(t, err)
+
+	for _, format := range []Format{FormatYAML, FormatJSON} {
+		var buffer bytes.Buffer
+		require.NoError(t, Export(&buffer, def, format, registry))
+		exported, err := Decode(buffer.Bytes(), format)
+		require.NoError(t, err)
+		require.Equal(t, original, exported)
+
+		reloaded, err := Load(&buffer, format, registry)
+		require.NoError(t, err)
+		require.Len(t, reloaded.TransitionTable, len(def.TransitionTable))
+	}
+
+	doc, err := NewDocument(def, registry)
+	require.NoError(t, err)
+	require.Equal(t, "approve", doc.States["Review"].Handler)
+	require.Equal(t, "ship", doc.States["Shipping"].Handler)
+	require.Equal(t, "isLarge", doc.States["AwaitingPayment"].GuardedTransitions["Paid"][0].Guard)
+
+	def.TransitionTable["Delivered"] = flow.StateConfig{
+		Final: true,
+		OnEntry: func(ctx context.Context, data flow.FlowData) error {
+			return nil
+		},
+	}
+	err = Export(&bytes.Buffer{}, def, FormatYAML, registry)
+	require.True(t, errors.Is(err, ErrUnnamedFunction))
+
+	ship := def.TransitionTable["Shipping"].Handler
+	registry.RegisterHandler("shipAgain", ship)
+	def.TransitionTable["Delivered"] = flow.StateConfig{Final: true}
+	err = Export(&bytes.Buffer{}, def, FormatYAML, registry)
+	require.True(t, errors.Is(err, ErrUnnamedFunction))
+}
@@ -0,0 +1,127 @@
+package flowdef
+
+import (
+	"context"
+	"unsafe"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+)
+
+// Hook is an entry or exit action of a state, see flow.StateConfig.OnEntry.
+type Hook = func(ctx context.Context, data flow.FlowData) error
+
+// Registry contains the Go functions, which are referenced by name in a Document:
+// action handlers, guards, hooks and compensation handlers.
+// Each kind of function has its own namespace, so a handler and a guard can have the same name.
+type Registry struct {
+	handlers      map[string]flow.ActionHandler
+	guards        map[string]flow.Guard
+	hooks         map[string]Hook
+	compensations map[string]flow.CompensationHandler
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		handlers:      make(map[string]flow.ActionHandler),
+		guards:        make(map[string]flow.Guard),
+		hooks:         make(map[string]Hook),
+		compensations: make(map[string]flow.CompensationHandler),
+	}
+}
+
+// RegisterHandler registers an action handler, e.g. a router converted by ToHandler.
+func (r *Registry) RegisterHandler(name string, handler flow.ActionHandler) *Registry {
+	r.handlers[name] = handler
+	return r
+}
+
+// RegisterGuard registers a guard of guarded transitions.
+func (r *Registry) RegisterGuard(name string, guard flow.Guard) *Registry {
+	r.guards[name] = guard
+	return r
+}
+
+// RegisterHook registers an entry or exit action.
+func (r *Registry) RegisterHook(name string, hook Hook) *Registry {
+	r.hooks[name] = hook
+	return r
+}
+
+// RegisterCompensation registers a compensation handler.
+func (r *Registry) RegisterCompensation(name string, compensation flow.CompensationHandler) *Registry {
+	r.compensations[name] = compensation
+	return r
+}
+
+func (r *Registry) handler(name string) (flow.ActionHandler, error) {
+	return lookup(r.handlers, "handler", name)
+}
+
+func (r *Registry) guard(name string) (flow.Guard, error) {
+	return lookup(r.guards, "guard", name)
+}
+
+func (r *Registry) hook(name string) (Hook, error) {
+	return lookup(r.hooks, "hook", name)
+}
+
+func (r *Registry) compensation(name string) (flow.CompensationHandler, error) {
+	return lookup(r.compensations, "compensation", name)
+}
+
+// lookup returns the function registered under a name. An empty name stands for no function.
+func lookup[F any](functions map[string]F, kind string, name string) (F, error) {
+	var fn F
+	if name == "" {
+		return fn, nil
+	}
+	fn, ok := functions[name]
+	if !ok {
+		return fn, errors.B().
+			Code(ErrUnknownName).
+			Op("flowdef.Load").
+			Msgf("%s %s is not registered", kind, name).Build()
+	}
+	return fn, nil
+}
+
+// nameOf returns the name, under which a function is registered. A nil function has an empty name.
+// Functions are compared by their identity, i.e. the function value returned by TypedHandler, TypedGuard or ToHandler
+// has to be registered itself. The same function value registered under more than one name is ambiguous.
+func nameOf[F any](functions map[string]F, kind string, fn F) (string, error) {
+	id := funcID(fn)
+	if id == nil {
+		return "", nil
+	}
+	found := ""
+	for name, registered := range functions {
+		if funcID(registered) != id {
+			continue
+		}
+		if found != "" {
+			first, second := found, name
+			if first > second {
+				first, second = second, first
+			}
+			return "", errors.B().
+				Code(ErrUnnamedFunction).
+				Op("flowdef.Export").
+				Msgf("%s is registered under more than one name: %s, %s", kind, first, second).Build()
+		}
+		found = name
+	}
+	if found == "" {
+		return "", errors.B().
+			Code(ErrUnnamedFunction).
+			Op("flowdef.Export").
+			Msgf("%s is not registered", kind).Build()
+	}
+	return found, nil
+}
+
+// funcID returns the identity of a function value. Unlike the code pointer returned by reflect.Value.Pointer,
+// it differs for two closures created by the same function literal. F must be a function type.
+func funcID[F any](fn F) unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&fn))
+}
@@ -0,0 +1,97 @@
+package flowengine
+
+import (
+	"context"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+	"github.com/necrobits/x/flow/flowregistry"
+	"github.com/necrobits/x/flow/flowrepo"
+	"github.com/necrobits/x/kvstore"
+)
+
+// Engine runs the actions of flows persisted in a kvstore.KvStore.
+// Actions for the same flow are handled one after another, while actions for different flows are handled in parallel.
+// The flow is loaded, the action is handled, and the flow is saved with flowrepo.FlowRepository.SaveRevision,
+// so a concurrent change of the flow by another process is detected, and the flow is never saved half-way.
+// Since the action is not handled inside a transaction of the store, its handlers and hooks may use the store as well.
+type Engine struct {
+	repo  *flowrepo.FlowRepository
+	locks *flowLocks
+}
+
+// New creates an Engine using the given store and data registry.
+// If the registry is nil, the global data registry is used.
+func New(store kvstore.KvStore, registry *flowregistry.DataRegistry) *Engine {
+	return &Engine{
+		repo:  flowrepo.New(store, registry),
+		locks: newFlowLocks(),
+	}
+}
+
+// Register registers the definition of a flow type, which is used to create and restore the flows of the type.
+func (e *Engine) Register(def *flow.Definition) {
+	e.repo.Register(def)
+}
+
+// Repository returns the repository, which is used by the engine.
+func (e *Engine) Repository() *flowrepo.FlowRepository {
+	return e.repo
+}
+
+// Create creates and saves a new flow of the given type.
+// It fails with flowrepo.ErrUnknownFlowType, if no definition is registered for the type,
+// and with flowrepo.ErrFlowExists, if a flow with the same ID already exists.
+func (e *Engine) Create(ctx context.Context, flowType flow.FlowType, id string, data flow.FlowData) (*flow.Flow, error) {
+	def := e.repo.Definition(flowType)
+	if def == nil {
+		return nil, errors.B().
+			Code(flowrepo.ErrUnknownFlowType).
+			Op("flowengine.Create").
+			Msgf("no definition registered for flow type %s", flowType).Build()
+	}
+	unlock, err := e.locks.acquire(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	f := def.New(id, data)
+	if err := e.repo.Create(ctx, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Load restores the flow with the given ID, without changing it.
+func (e *Engine) Load(ctx context.Context, id string) (*flow.Flow, error) {
+	return e.repo.Load(ctx, id)
+}
+
+// Dispatch loads the flow with the given ID, handles the action, and saves the flow, if its revision has changed.
+// A failed action is saved as well, if it has changed the flow before failing, or if it is recorded in the history
+// of the flow, see flow.Flow.HandleAction. Otherwise, the flow is not saved.
+// The error of the action is returned with the flow.
+//
+// If the flow cannot be loaded or saved, nothing is changed in the store, and only the error is returned.
+// If the flow has been saved by another process since it was loaded, the error has the code flowrepo.ErrStaleRevision.
+func (e *Engine) Dispatch(ctx context.Context, flowID string, action flow.Action) (*flow.Flow, error) {
+	unlock, err := e.locks.acquire(ctx, flowID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	f, err := e.repo.Load(ctx, flowID)
+	if err != nil {
+		return nil, err
+	}
+	revision := f.Revision()
+	actionErr := f.HandleAction(ctx, action)
+	if f.Revision() == revision {
+		return f, actionErr
+	}
+	if err := e.repo.SaveRevision(ctx, f, revision); err != nil {
+		return nil, err
+	}
+	return f, actionErr
+}
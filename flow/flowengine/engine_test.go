@@ -0,0 +1,309 @@
+package flowengine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+	"github.com/necrobits/x/flow/flowregistry"
+	"github.com/necrobits/x/flow/flowrepo"
+	"github.com/necrobits/x/kvstore/memstore"
+	"github.com/stretchr/testify/require"
+)
+
+type counterData struct {
+	Count int
+}
+
+type counterAction struct {
+	Kind flow.ActionType
+}
+
+func (a counterAction) Type() flow.ActionType {
+	return a.Kind
+}
+
+// waitAction blocks its handler, until it is released.
+type waitAction struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (a waitAction) Type() flow.ActionType {
+	return "Wait"
+}
+
+func newEngine() *Engine {
+	registry := flowregistry.NewDataRegistry()
+	registry.Register("Counter", counterData{})
+	store := memstore.New()
+	e := New(store, registry)
+	e.Register(&flow.Definition{
+		Type:         "Counter",
+		InitialState: "Counting",
+		TransitionTable: flow.TransitionTable{
+			"Counting": flow.StateConfig{
+				Handler: func(ctx context.Context, data flow.FlowData, a flow.Action) (flow.Event, flow.FlowData, error) {
+					counter := *data.(*counterData)
+					switch a.Type() {
+					case "Increment":
+						counter.Count++
+						return flow.NoEvent, &counter, nil
+					case "Stop":
+						return "Stopped", &counter, nil
+					case "Pause":
+						return "Paused", &counter, nil
+					case "Audit":
+						return flow.NoEvent, data, store.Set(ctx, "audit", counter.Count)
+					case "Wait":
+						close(a.(waitAction).started)
+						<-a.(waitAction).release
+						return flow.NoEvent, data, nil
+					}
+					return flow.NoEvent, data, fmt.Errorf("unsupported action: %s", a.Type())
+				},
+				Transitions: flow.Transitions{"Stopped": "Done", "Paused": "Pausing"},
+			},
+			"Pausing": flow.StateConfig{
+				Autopass: true,
+				Handler: func(ctx context.Context, data flow.FlowData, a flow.Action) (flow.Event, flow.FlowData, error) {
+					return flow.NoEvent, data, fmt.Errorf("cannot pause")
+				},
+			},
+			"Done": flow.StateConfig{Final: true},
+		},
+		History: &flow.HistoryPolicy{MaxEntries: 10},
+	})
+	return e
+}
+
+func TestDispatch(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Concurrent", func(t *testing.T) {
+		e := newEngine()
+		_, err := e.Create(ctx, "Counter", "1", &counterData{})
+		require.NoError(t, err)
+		var wg sync.WaitGroup
+		errs := make(chan error, 50)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := e.Dispatch(ctx, "1", counterAction{"Increment"})
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+		f, err := e.Load(ctx, "1")
+		require.NoError(t, err)
+		require.Equal(t, &counterData{Count: 50}, f.Data())
+		require.Equal(t, uint64(50), f.Revision())
+		require.Empty(t, e.locks.locks)
+	})
+
+	t.Run("Transition", func(t *testing.T) {
+		e := newEngine()
+		_, err := e.Create(ctx, "Counter", "1", &counterData{})
+		require.NoError(t, err)
+		f, err := e.Dispatch(ctx, "1", counterAction{"Stop"})
+		require.NoError(t, err)
+		require.True(t, f.IsCompleted())
+		f, err = e.Load(ctx, "1")
+		require.NoError(t, err)
+		require.Equal(t, flow.State("Done"), f.CurrentState())
+	})
+
+	t.Run("ActionError", func(t *testing.T) {
+		e := newEngine()
+		_, err := e.Create(ctx, "Counter", "1", &counterData{})
+		require.NoError(t, err)
+		f, err := e.Dispatch(ctx, "1", counterAction{"Reset"})
+		require.Error(t, err)
+		require.Equal(t, flow.State("Counting"), f.CurrentState())
+		require.Equal(t, uint64(1), f.Revision())
+
+		f, err = e.Load(ctx, "1")
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), f.Revision())
+		history := f.History()
+		require.Len(t, history, 1)
+		require.Equal(t, flow.ActionType("Reset"), history[0].ActionType)
+		require.Equal(t, "unsupported action: Reset", history[0].Error)
+	})
+
+	t.Run("ParallelFlows", func(t *testing.T) {
+		e := newEngine()
+		for _, id := range []string{"1", "2"} {
+			_, err := e.Create(ctx, "Counter", id, &counterData{})
+			require.NoError(t, err)
+		}
+		wait := waitAction{started: make(chan struct{}), release: make(chan struct{})}
+		errs := make(chan error, 1)
+		go func() {
+			_, err := e.Dispatch(ctx, "1", wait)
+			errs <- err
+		}()
+		<-wait.started
+		_, err := e.Dispatch(ctx, "2", counterAction{"Increment"})
+		require.NoError(t, err)
+		close(wait.release)
+		require.NoError(t, <-errs)
+	})
+
+	t.Run("StoreInHandler", func(t *testing.T) {
+		e := newEngine()
+		_, err := e.Create(ctx, "Counter", "1", &counterData{})
+		require.NoError(t, err)
+		f, err := e.Dispatch(ctx, "1", counterAction{"Audit"})
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), f.Revision())
+	})
+
+	t.Run("FailedChain", func(t *testing.T) {
+		e := newEngine()
+		_, err := e.Create(ctx, "Counter", "1", &counterData{})
+		require.NoError(t, err)
+		f, err := e.Dispatch(ctx, "1", counterAction{"Pause"})
+		require.EqualError(t, err, "cannot pause")
+		require.Equal(t, uint64(1), f.Revision())
+
+		f, err = e.Load(ctx, "1")
+		require.NoError(t, err)
+		require.Equal(t, flow.State("Pausing"), f.CurrentState())
+		require.Equal(t, uint64(1), f.Revision())
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := newEngine().Dispatch(ctx, "1", counterAction{"Increment"})
+		require.True(t, errors.Is(err, flowrepo.ErrFlowNotFound))
+	})
+
+	t.Run("Exists", func(t *testing.T) {
+		e := newEngine()
+		_, err := e.Create(ctx, "Counter", "1", &counterData{})
+		require.NoError(t, err)
+		_, err = e.Create(ctx, "Counter", "1", &counterData{})
+		require.True(t, errors.Is(err, flowrepo.ErrFlowExists))
+	})
+
+	t.Run("UnknownFlowType", func(t *testing.T) {
+		_, err := newEngine().Create(ctx, "Timer", "1", nil)
+		require.True(t, errors.Is(err, flowrepo.ErrUnknownFlowType))
+	})
+}
+
+func TestFlowLocks(t *testing.T) {
+	ctx := context.Background()
+	locks := newFlowLocks()
+	unlockA, err := locks.acquire(ctx, "a")
+	require.NoError(t, err)
+
+	unlockB, err := locks.acquire(ctx, "b")
+	require.NoError(t, err)
+	unlockB()
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = locks.acquire(timeoutCtx, "a")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	unlockA()
+	unlockA, err = locks.acquire(ctx, "a")
+	require.NoError(t, err)
+	unlockA()
+	require.Empty(t, locks.locks)
+}
+
+func TestSweeper(t *testing.T) {
+	ctx := context.Background()
+	registry := flowregistry.NewDataRegistry()
+	registry.Register("Counter", counterData{})
+	registry.Register("ExpiringCounter", counterData{})
+	e := New(memstore.New(), registry)
+	e.Register(newEngine().Repository().Definition("Counter"))
+	def := *e.Repository().Definition("Counter")
+	def.Type = "ExpiringCounter"
+	def.ExpireIn = time.Hour
+	def.ExpirationEvent = "Stopped"
+	e.Register(&def)
+	registry.Register("OverdueCounter", counterData{})
+	overdue := *e.Repository().Definition("Counter")
+	overdue.Type = "OverdueCounter"
+	overdue.ExpireIn = time.Hour
+	overdue.ExpirationState = "Overdue"
+	overdue.TransitionTable = flow.TransitionTable{
+		"Counting": overdue.TransitionTable["Counting"],
+		"Overdue": flow.StateConfig{
+			After:       []flow.Timer{{Delay: 30 * time.Minute, Event: "Stopped"}},
+			Transitions: flow.Transitions{"Stopped": "Done"},
+		},
+		"Done": flow.StateConfig{Final: true},
+	}
+	e.Register(&overdue)
+	registry.Register("TimedCounter", counterData{})
+	timed := *e.Repository().Definition("Counter")
+	timed.Type = "TimedCounter"
+	timed.ExpireIn = time.Hour
+	e.Register(&timed)
+	completed := 0
+	flow.HookRegistry().RegisterCompletion("ExpiringCounter", func(ctx context.Context, data flow.FlowData) {
+		completed++
+	})
+	for _, id := range []string{"1", "2"} {
+		_, err := e.Create(ctx, "ExpiringCounter", id, &counterData{})
+		require.NoError(t, err)
+	}
+	_, err := e.Create(ctx, "Counter", "3", &counterData{})
+	require.NoError(t, err)
+	_, err = e.Create(ctx, "OverdueCounter", "4", &counterData{})
+	require.NoError(t, err)
+	_, err = e.Create(ctx, "TimedCounter", "5", &counterData{})
+	require.NoError(t, err)
+	_, err = e.Dispatch(ctx, "2", counterAction{"Stop"})
+	require.NoError(t, err)
+
+	now := time.Now()
+	sweeper := NewSweeper(e, func() time.Time { return now })
+	result, err := sweeper.Sweep(ctx)
+	require.NoError(t, err)
+	require.Empty(t, result.Expired)
+
+	now = now.Add(2 * time.Hour)
+	ids, err := e.Repository().FindExpired(ctx, now)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "4"}, ids)
+	result, err = sweeper.Sweep(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "4"}, result.Expired)
+	require.Empty(t, result.Failed)
+	require.Equal(t, 2, completed)
+
+	f, err := e.Load(ctx, "1")
+	require.NoError(t, err)
+	require.Equal(t, flow.State("Done"), f.CurrentState())
+	require.True(t, f.IsCompleted())
+	require.Equal(t, uint64(1), f.Revision())
+
+	f, err = e.Load(ctx, "4")
+	require.NoError(t, err)
+	require.Equal(t, flow.State("Overdue"), f.CurrentState())
+	require.Len(t, f.Deadlines(), 1)
+	require.True(t, f.Deadlines()[0].DueAt.Equal(now.Add(30*time.Minute)))
+
+	ids, err = e.Repository().FindExpired(ctx, now)
+	require.NoError(t, err)
+	require.Empty(t, ids)
+	result, err = sweeper.Sweep(ctx)
+	require.NoError(t, err)
+	require.Empty(t, result.Expired)
+	require.Empty(t, e.locks.locks)
+}
@@ -0,0 +1,57 @@
+package flowengine
+
+import (
+	"context"
+	"sync"
+)
+
+// flowLocks serializes the work on the same flow, while the work on different flows runs in parallel.
+// A lock only exists while it is held or waited for.
+type flowLocks struct {
+	mu    sync.Mutex
+	locks map[string]*flowLock
+}
+
+type flowLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+func newFlowLocks() *flowLocks {
+	return &flowLocks{
+		locks: make(map[string]*flowLock),
+	}
+}
+
+// acquire waits until the lock of the flow is acquired, or the context is done.
+// It returns the function, which releases the lock.
+func (l *flowLocks) acquire(ctx context.Context, id string) (func(), error) {
+	l.mu.Lock()
+	lock, ok := l.locks[id]
+	if !ok {
+		lock = &flowLock{ch: make(chan struct{}, 1)}
+		l.locks[id] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	select {
+	case lock.ch <- struct{}{}:
+		return func() {
+			<-lock.ch
+			l.release(id, lock)
+		}, nil
+	case <-ctx.Done():
+		l.release(id, lock)
+		return nil, ctx.Err()
+	}
+}
+
+func (l *flowLocks) release(id string, lock *flowLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, id)
+	}
+}
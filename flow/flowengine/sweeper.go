@@ -0,0 +1,98 @@
+package flowengine
+
+import (
+	"context"
+	"time"
+)
+
+// Clock returns the current time. It is injected into a Sweeper, so the expiration can be tested without waiting.
+type Clock func() time.Time
+
+// SweepResult is the outcome of a single sweep.
+type SweepResult struct {
+	// Expired contains the IDs of the flows, which have followed their expiration transition.
+	Expired []string
+	// Failed contains the errors of the flows, which could not be expired. They are retried by the next sweep.
+	Failed map[string]error
+}
+
+// Sweeper scans the store of an engine for expired flows, and moves them along their expiration transition,
+// see flow.Flow.Expire. If the transition reaches a final state, the completion hooks of the flow are called.
+// The states entered by the transition start their timers at the time of the clock.
+// Expired flows without an expiration transition are left as they are, see flowrepo.FlowRepository.FindExpired.
+type Sweeper struct {
+	engine *Engine
+	clock  Clock
+}
+
+// NewSweeper creates a Sweeper for the flows of the engine. If the clock is nil, time.Now is used.
+func NewSweeper(e *Engine, clock Clock) *Sweeper {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &Sweeper{
+		engine: e,
+		clock:  clock,
+	}
+}
+
+// Sweep expires the flows, which have expired at the current time of the clock.
+// Every flow is expired like an action is dispatched, see Engine.Dispatch.
+// A flow, which fails to expire, does not stop the sweep, its error is reported in the result instead.
+func (s *Sweeper) Sweep(ctx context.Context) (*SweepResult, error) {
+	now := s.clock()
+	ids, err := s.engine.repo.FindExpired(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	result := &SweepResult{Failed: make(map[string]error)}
+	for _, id := range ids {
+		expired, err := s.expire(ctx, id, now)
+		if err != nil {
+			result.Failed[id] = err
+		} else if expired {
+			result.Expired = append(result.Expired, id)
+		}
+	}
+	return result, nil
+}
+
+// Run sweeps the store every interval, until the context is done.
+func (s *Sweeper) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.Sweep(ctx); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// expire loads the flow, expires it and saves it, and reports whether it has been changed.
+func (s *Sweeper) expire(ctx context.Context, id string, now time.Time) (bool, error) {
+	unlock, err := s.engine.locks.acquire(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	f, err := s.engine.repo.Load(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	revision := f.Revision()
+	expireErr := f.Expire(ctx, now)
+	if f.Revision() == revision {
+		// The flow has not been changed, e.g. it has been completed since the scan, or the expiration has failed right away.
+		return false, expireErr
+	}
+	if err := s.engine.repo.SaveRevision(ctx, f, revision); err != nil {
+		return false, err
+	}
+	return expireErr == nil, expireErr
+}
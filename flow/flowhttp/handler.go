@@ -0,0 +1,316 @@
+// Package flowhttp exposes the flows of a flowengine.Engine over HTTP. The Handler serves the following routes:
+//
+//	POST /flows                create a flow: {"type": "Order", "id": "1", "data": {...}}
+//	GET  /flows/{id}           get the state, the data and the available events of a flow
+//	POST /flows/{id}/actions   handle an action: {"type": "Pay", "payload": {...}}
+//
+// The routes are relative to the handler, so it can be mounted under any prefix with http.StripPrefix.
+// Every response is JSON: a FlowView on success, and an ErrorResponse on failure.
+// The status of a failure is mapped from the code of the error, for example:
+//
+//	flowrepo.ErrFlowNotFound   404 Not Found
+//	flow.ErrFlowCompleted      409 Conflict
+//	flow.ErrFlowExpired        410 Gone
+//	flow.ErrNoTransition       422 Unprocessable Entity
+//	flow.ErrPanic              500 Internal Server Error
+//
+// Further codes can be mapped with Handler.WithStatusCode.
+package flowhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+	"github.com/necrobits/x/flow/flowengine"
+	"github.com/necrobits/x/flow/flowregistry"
+	"github.com/necrobits/x/flow/flowrepo"
+)
+
+const (
+	// ErrInvalidRequest is returned when the body of a request is malformed.
+	ErrInvalidRequest = "invalid_request"
+	// ErrMethodNotAllowed is returned when a route does not support the method of the request.
+	ErrMethodNotAllowed = "method_not_allowed"
+	// ErrActionFailed is returned when an action has been handled by the flow, but failed without an error code,
+	// e.g. because its handler returned a plain error.
+	ErrActionFailed = "action_failed"
+)
+
+// maxBodySize is the maximum size of a request body.
+const maxBodySize = 1 << 20
+
+var defaultStatusCodes = map[string]int{
+	ErrInvalidRequest:                 http.StatusBadRequest,
+	ErrMethodNotAllowed:               http.StatusMethodNotAllowed,
+	ErrActionFailed:                   http.StatusUnprocessableEntity,
+	errors.ENotFound:                  http.StatusNotFound,
+	flowrepo.ErrFlowNotFound:          http.StatusNotFound,
+	flowrepo.ErrFlowExists:            http.StatusConflict,
+	flowrepo.ErrStaleRevision:         http.StatusConflict,
+	flowrepo.ErrUnknownFlowType:       http.StatusBadRequest,
+	flowregistry.ErrUnknownActionType: http.StatusBadRequest,
+	flowregistry.ErrInvalidAction:     http.StatusBadRequest,
+	flow.ErrNoPassingGuard:            http.StatusUnprocessableEntity,
+	flow.ErrNoRoute:                   http.StatusUnprocessableEntity,
+	flow.ErrCompensating:              http.StatusConflict,
+	flow.ErrFlowCompleted:             http.StatusConflict,
+	flow.ErrFlowExpired:               http.StatusGone,
+	flow.ErrNoTransition:              http.StatusUnprocessableEntity,
+	flow.ErrPanic:                     http.StatusInternalServerError,
+}
+
+// Handler is an http.Handler, which creates the flows of an engine, handles their actions, and returns their state.
+type Handler struct {
+	engine      *flowengine.Engine
+	data        *flowregistry.DataRegistry
+	actions     *flowregistry.ActionRegistry
+	statusCodes map[string]int
+	// exposeErrors enables the messages of the plain errors returned by action handlers in the responses.
+	exposeErrors bool
+}
+
+// New creates a Handler for the flows of the engine. The data registry decodes the initial data of new flows,
+// and the action registry decodes the actions. If the data registry is nil, the global data registry is used.
+func New(engine *flowengine.Engine, data *flowregistry.DataRegistry, actions *flowregistry.ActionRegistry) *Handler {
+	if data == nil {
+		data = flowregistry.Global()
+	}
+	statusCodes := make(map[string]int, len(defaultStatusCodes))
+	for code, status := range defaultStatusCodes {
+		statusCodes[code] = status
+	}
+	return &Handler{
+		engine:      engine,
+		data:        data,
+		actions:     actions,
+		statusCodes: statusCodes,
+	}
+}
+
+// WithStatusCode maps an error code to an HTTP status, e.g. the code of an error returned by an action handler.
+// Errors without a mapped code are returned with the status 422 if they are returned by an action, and 500 otherwise.
+func (h *Handler) WithStatusCode(code string, status int) *Handler {
+	h.statusCodes[code] = status
+	return h
+}
+
+// WithErrorMessages enables the messages of the plain errors returned by action handlers in the responses.
+// By default, such an error is answered with a generic message, since it may contain internal details.
+func (h *Handler) WithErrorMessages(expose bool) *Handler {
+	h.exposeErrors = expose
+	return h
+}
+
+// FlowView is the JSON representation of a flow.
+type FlowView struct {
+	ID               string            `json:"id"`
+	Type             flow.FlowType     `json:"type"`
+	State            flow.State        `json:"state"`
+	ActiveStates     []flow.State      `json:"active_states"`
+	Data             flow.FlowData     `json:"data"`
+	AvailableEvents  []flow.Event      `json:"available_events"`
+	AvailableActions []flow.ActionType `json:"available_actions"`
+	Completed        bool              `json:"completed"`
+	Expired          bool              `json:"expired"`
+	ExpiresAt        *time.Time        `json:"expires_at,omitempty"`
+	Revision         uint64            `json:"revision"`
+}
+
+// NewFlowView creates the JSON representation of a flow.
+func NewFlowView(f *flow.Flow) *FlowView {
+	view := &FlowView{
+		ID:               f.ID(),
+		Type:             f.Type(),
+		State:            f.CurrentState(),
+		ActiveStates:     f.ActiveStates(),
+		Data:             f.Data(),
+		AvailableEvents:  f.AvailableEvents(),
+		AvailableActions: f.AvailableActions(),
+		Completed:        f.IsCompleted(),
+		Expired:          f.IsExpired(),
+		Revision:         f.Revision(),
+	}
+	if expiresAt := f.ExpiresAt(); !expiresAt.IsZero() {
+		view.ExpiresAt = &expiresAt
+	}
+	return view
+}
+
+// ErrorResponse is the JSON representation of a failed request.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+	// Flow is the flow after a failed action, since the flow may have changed before the failure.
+	Flow *FlowView `json:"flow,omitempty"`
+}
+
+// ErrorBody describes an error by its code and a message.
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// CreateRequest is the body of a request creating a flow.
+type CreateRequest struct {
+	Type flow.FlowType   `json:"type"`
+	ID   string          `json:"id"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(segments) == 1 && segments[0] == "flows":
+		if h.allow(w, r, http.MethodPost) {
+			h.create(w, r)
+		}
+	case len(segments) == 2 && segments[0] == "flows" && segments[1] != "":
+		if h.allow(w, r, http.MethodGet) {
+			h.get(w, r, segments[1])
+		}
+	case len(segments) == 3 && segments[0] == "flows" && segments[1] != "" && segments[2] == "actions":
+		if h.allow(w, r, http.MethodPost) {
+			h.dispatch(w, r, segments[1])
+		}
+	default:
+		h.writeError(w, errors.B().
+			Code(errors.ENotFound).
+			Op("flowhttp.ServeHTTP").
+			Msgf("no route for %s", r.URL.Path).Build(), nil)
+	}
+}
+
+func (h *Handler) allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	h.writeError(w, errors.B().
+		Code(ErrMethodNotAllowed).
+		Op("flowhttp.ServeHTTP").
+		Msgf("method %s not allowed for %s", r.Method, r.URL.Path).Build(), nil)
+	return false
+}
+
+func (h *Handler) create(w http.ResponseWriter, r *http.Request) {
+	var req CreateRequest
+	if err := h.decodeBody(w, r, &req); err != nil {
+		h.writeError(w, err, nil)
+		return
+	}
+	if req.Type == "" || req.ID == "" {
+		h.writeError(w, errors.B().
+			Code(ErrInvalidRequest).
+			Op("flowhttp.Create").
+			Msg("type and id are required").Build(), nil)
+		return
+	}
+	if h.engine.Repository().Definition(req.Type) == nil {
+		h.writeError(w, errors.B().
+			Code(flowrepo.ErrUnknownFlowType).
+			Op("flowhttp.Create").
+			Msgf("unknown flow type %s", req.Type).Build(), nil)
+		return
+	}
+	if len(req.Data) == 0 {
+		req.Data = json.RawMessage("null")
+	}
+	data, err := h.data.Unmarshal(req.Type, req.Data)
+	if err != nil {
+		h.writeError(w, errors.B().
+			Code(ErrInvalidRequest).
+			Op("flowhttp.Create").
+			Msgf("invalid data for flow type %s", req.Type).
+			Err(err).Build(), nil)
+		return
+	}
+	f, err := h.engine.Create(r.Context(), req.Type, req.ID, data)
+	if err != nil {
+		h.writeError(w, err, nil)
+		return
+	}
+	h.writeJSON(w, http.StatusCreated, NewFlowView(f))
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, id string) {
+	f, err := h.engine.Load(r.Context(), id)
+	if err != nil {
+		h.writeError(w, err, nil)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, NewFlowView(f))
+}
+
+func (h *Handler) dispatch(w http.ResponseWriter, r *http.Request, id string) {
+	var raw json.RawMessage
+	if err := h.decodeBody(w, r, &raw); err != nil {
+		h.writeError(w, err, nil)
+		return
+	}
+	action, err := h.actions.DecodeAction(raw)
+	if err != nil {
+		h.writeError(w, err, nil)
+		return
+	}
+	f, err := h.engine.Dispatch(r.Context(), id, action)
+	if err != nil {
+		var view *FlowView
+		if f != nil {
+			view = NewFlowView(f)
+		}
+		h.writeError(w, err, view)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, NewFlowView(f))
+}
+
+func (h *Handler) decodeBody(w http.ResponseWriter, r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err := decoder.Decode(v); err != nil {
+		return errors.B().
+			Code(ErrInvalidRequest).
+			Op("flowhttp.ServeHTTP").
+			Msg("malformed request body").
+			Err(err).Build()
+	}
+	return nil
+}
+
+// writeError writes the error with the status of its code. If the view is set, the error is returned by an action,
+// which has been handled by the flow. The message of an internal error is not exposed, and neither is the message
+// of a plain error returned by an action, unless it is enabled by WithErrorMessages.
+func (h *Handler) writeError(w http.ResponseWriter, err error, view *FlowView) {
+	code := errors.RootErrCode(err)
+	message := errors.ErrorMessage(err)
+	if view != nil && !errors.IsAppError(err) {
+		code = ErrActionFailed
+		message = "The action failed."
+		if h.exposeErrors {
+			message = err.Error()
+		}
+	}
+	status, ok := h.statusCodes[code]
+	if !ok {
+		status = http.StatusInternalServerError
+		if view != nil {
+			status = http.StatusUnprocessableEntity
+		}
+	}
+	if status >= http.StatusInternalServerError {
+		message = "An internal error occurred."
+	}
+	h.writeJSON(w, status, ErrorResponse{
+		Error: ErrorBody{Code: code, Message: message},
+		Flow:  view,
+	})
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
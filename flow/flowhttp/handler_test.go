@@ -0,0 +1,187 @@
+package flowhttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/necrobits/x/flow"
+	"github.com/necrobits/x/flow/flowengine"
+	"github.com/necrobits/x/flow/flowregistry"
+	"github.com/necrobits/x/flow/flowrepo"
+	"github.com/necrobits/x/kvstore/memstore"
+	"github.com/stretchr/testify/require"
+)
+
+type orderData struct {
+	Amount int  `json:"amount"`
+	Paid   bool `json:"paid"`
+}
+
+type payAction struct {
+	Amount int `json:"amount"`
+}
+
+func (a payAction) Type() flow.ActionType {
+	return "Pay"
+}
+
+func newHandler() *Handler {
+	data := flowregistry.NewDataRegistry()
+	data.Register("Order", orderData{})
+	e := flowengine.New(memstore.New(), data)
+	e.Register(&flow.Definition{
+		Type:         "Order",
+		InitialState: "AwaitingPayment",
+		TransitionTable: flow.TransitionTable{
+			"AwaitingPayment": flow.StateConfig{
+				Actions: []flow.ActionType{"Pay"},
+				Handler: func(ctx context.Context, data flow.FlowData, a flow.Action) (flow.Event, flow.FlowData, error) {
+					order := *data.(*orderData)
+					if a.(payAction).Amount < 0 {
+						return "Refunded", data, nil
+					}
+					if a.(payAction).Amount == 13 {
+						panic("unlucky amount")
+					}
+					if a.(payAction).Amount < order.Amount {
+						return flow.NoEvent, data, fmt.Errorf("insufficient payment")
+					}
+					order.Paid = true
+					return "Paid", &order, nil
+				},
+				Transitions: flow.Transitions{"Paid": "Completed"},
+			},
+			"Completed": flow.StateConfig{Final: true},
+		},
+	})
+	return New(e, data, flowregistry.NewActionRegistry().Register("Pay", payAction{}))
+}
+
+func serve(t *testing.T, h http.Handler, method string, path string, body string) (int, map[string]any) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var res map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	return rec.Code, res
+}
+
+func errorCode(res map[string]any) any {
+	return res["error"].(map[string]any)["code"]
+}
+
+func errorMessage(res map[string]any) any {
+	return res["error"].(map[string]any)["message"]
+}
+
+func TestHandler(t *testing.T) {
+	t.Run("Lifecycle", func(t *testing.T) {
+		h := newHandler()
+		status, res := serve(t, h, http.MethodPost, "/flows", `{"type":"Order","id":"1","data":{"amount":10}}`)
+		require.Equal(t, http.StatusCreated, status)
+		require.Equal(t, "AwaitingPayment", res["state"])
+
+		status, res = serve(t, h, http.MethodGet, "/flows/1", "")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, map[string]any{"amount": float64(10), "paid": false}, res["data"])
+		require.Equal(t, []any{"Paid"}, res["available_events"])
+		require.Equal(t, []any{"Pay"}, res["available_actions"])
+
+		status, res = serve(t, h, http.MethodPost, "/flows/1/actions", `{"type":"Pay","payload":{"amount":5}}`)
+		require.Equal(t, http.StatusUnprocessableEntity, status)
+		require.Equal(t, ErrActionFailed, errorCode(res))
+		require.Equal(t, "The action failed.", errorMessage(res))
+		require.Equal(t, "AwaitingPayment", res["flow"].(map[string]any)["state"])
+
+		status, res = serve(t, h, http.MethodPost, "/flows/1/actions", `{"type":"Pay","payload":{"amount":10}}`)
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "Completed", res["state"])
+		require.Equal(t, true, res["completed"])
+		require.Equal(t, float64(1), res["revision"])
+
+		status, res = serve(t, h, http.MethodPost, "/flows/1/actions", `{"type":"Pay","payload":{"amount":10}}`)
+		require.Equal(t, http.StatusConflict, status)
+		require.Equal(t, flow.ErrFlowCompleted, errorCode(res))
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		h := newHandler()
+		status, _ := serve(t, h, http.MethodPost, "/flows", `{"type":"Order","id":"1"}`)
+		require.Equal(t, http.StatusCreated, status)
+
+		tests := []struct {
+			method string
+			path   string
+			body   string
+			status int
+			code   string
+		}{
+			{http.MethodPost, "/flows", `{"type":"Order","id":"1"}`, http.StatusConflict, flowrepo.ErrFlowExists},
+			{http.MethodPost, "/flows", `{"type":"Invoice","id":"2"}`, http.StatusBadRequest, flowrepo.ErrUnknownFlowType},
+			{http.MethodPost, "/flows", `{"type":"Order"}`, http.StatusBadRequest, ErrInvalidRequest},
+			{http.MethodPost, "/flows", `{"type":`, http.StatusBadRequest, ErrInvalidRequest},
+			{http.MethodGet, "/flows/2", "", http.StatusNotFound, flowrepo.ErrFlowNotFound},
+			{http.MethodPost, "/flows/2/actions", `{"type":"Pay"}`, http.StatusNotFound, flowrepo.ErrFlowNotFound},
+			{http.MethodPost, "/flows/1/actions", `{"type":"Refund"}`, http.StatusBadRequest, flowregistry.ErrUnknownActionType},
+			{http.MethodDelete, "/flows/1", "", http.StatusMethodNotAllowed, ErrMethodNotAllowed},
+			{http.MethodGet, "/orders/1", "", http.StatusNotFound, "not_found"},
+		}
+		for _, test := range tests {
+			status, res := serve(t, h, test.method, test.path, test.body)
+			require.Equal(t, test.status, status, "%s %s", test.method, test.path)
+			require.Equal(t, test.code, errorCode(res), "%s %s", test.method, test.path)
+		}
+	})
+
+	t.Run("FlowErrors", func(t *testing.T) {
+		h := newHandler()
+		status, _ := serve(t, h, http.MethodPost, "/flows", `{"type":"Order","id":"1","data":{"amount":10}}`)
+		require.Equal(t, http.StatusCreated, status)
+		status, res := serve(t, h, http.MethodPost, "/flows/1/actions", `{"type":"Pay","payload":{"amount":-1}}`)
+		require.Equal(t, http.StatusUnprocessableEntity, status)
+		require.Equal(t, flow.ErrNoTransition, errorCode(res))
+
+		status, res = serve(t, h, http.MethodPost, "/flows/1/actions", `{"type":"Pay","payload":{"amount":13}}`)
+		require.Equal(t, http.StatusInternalServerError, status)
+		require.Equal(t, flow.ErrPanic, errorCode(res))
+		require.Equal(t, "An internal error occurred.", errorMessage(res))
+
+		f, err := h.engine.Load(context.Background(), "1")
+		require.NoError(t, err)
+		f.SetExpirationAt(time.Now().Add(-time.Minute))
+		require.NoError(t, h.engine.Repository().Save(context.Background(), f))
+		status, res = serve(t, h, http.MethodPost, "/flows/1/actions", `{"type":"Pay","payload":{"amount":10}}`)
+		require.Equal(t, http.StatusGone, status)
+		require.Equal(t, flow.ErrFlowExpired, errorCode(res))
+	})
+
+	t.Run("StatusCode", func(t *testing.T) {
+		h := newHandler().WithStatusCode(ErrActionFailed, http.StatusConflict)
+		serve(t, h, http.MethodPost, "/flows", `{"type":"Order","id":"1","data":{"amount":10}}`)
+		status, _ := serve(t, h, http.MethodPost, "/flows/1/actions", `{"type":"Pay","payload":{"amount":5}}`)
+		require.Equal(t, http.StatusConflict, status)
+	})
+
+	t.Run("ErrorMessages", func(t *testing.T) {
+		h := newHandler().WithErrorMessages(true)
+		serve(t, h, http.MethodPost, "/flows", `{"type":"Order","id":"1","data":{"amount":10}}`)
+		status, res := serve(t, h, http.MethodPost, "/flows/1/actions", `{"type":"Pay","payload":{"amount":5}}`)
+		require.Equal(t, http.StatusUnprocessableEntity, status)
+		require.Equal(t, "insufficient payment", errorMessage(res))
+	})
+
+	t.Run("Prefix", func(t *testing.T) {
+		h := http.StripPrefix("/api", newHandler())
+		status, _ := serve(t, h, http.MethodPost, "/api/flows", `{"type":"Order","id":"1"}`)
+		require.Equal(t, http.StatusCreated, status)
+		status, _ = serve(t, h, http.MethodGet, "/api/flows/1", "")
+		require.Equal(t, http.StatusOK, status)
+	})
+}
@@ -0,0 +1,121 @@
+package flowjournal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+	"github.com/necrobits/x/kvstore"
+)
+
+var _ flow.Journal = &journal{}
+
+const (
+	// ErrOutOfOrder is returned when an appended entry does not follow the last entry of the journal.
+	ErrOutOfOrder = "journal_out_of_order"
+	// ErrNoSnapshot is returned when the journal does not contain a snapshot.
+	ErrNoSnapshot = "no_snapshot"
+)
+
+// journal is a flow.Journal, which stores the entries and the latest snapshot of a flow in a kvstore.KvStore.
+// The keys of a flow are prefixed with "journal/<flow ID>/".
+type journal struct {
+	store  kvstore.KvStore
+	flowID string
+}
+
+// New creates a journal for the flow with the given ID, backed by the store.
+func New(store kvstore.KvStore, flowID string) *journal {
+	return &journal{
+		store:  store,
+		flowID: flowID,
+	}
+}
+
+// Append implements flow.Journal.
+// The entry and the new head of the journal are written in a transaction.
+func (j *journal) Append(ctx context.Context, entry flow.JournalEntry) error {
+	return j.store.Transaction(ctx, func(tx kvstore.KvStore) error {
+		head, err := j.head(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if entry.Seq != head+1 {
+			return errors.B().
+				Code(ErrOutOfOrder).
+				Op("flowjournal.Append").
+				Msgf("entry %d does not follow entry %d of flow %s", entry.Seq, head, j.flowID).Build()
+		}
+		return tx.SetMany(ctx, map[string]any{
+			j.entryKey(entry.Seq): entry,
+			j.headKey():           entry.Seq,
+		})
+	})
+}
+
+// Entries implements flow.Journal.
+func (j *journal) Entries(ctx context.Context, seq uint64) ([]flow.JournalEntry, error) {
+	head, err := j.head(ctx, j.store)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]flow.JournalEntry, 0)
+	for i := seq + 1; i <= head; i++ {
+		var entry flow.JournalEntry
+		if err := j.store.Get(ctx, j.entryKey(i), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// SaveSnapshot implements flow.Journal.
+func (j *journal) SaveSnapshot(ctx context.Context, s *flow.Snapshot) error {
+	return j.store.Set(ctx, j.snapshotKey(), *s)
+}
+
+// LatestSnapshot implements flow.Journal.
+func (j *journal) LatestSnapshot(ctx context.Context) (*flow.Snapshot, error) {
+	ok, err := j.store.Has(ctx, j.snapshotKey())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.B().
+			Code(ErrNoSnapshot).
+			Op("flowjournal.LatestSnapshot").
+			Msgf("no snapshot of flow %s", j.flowID).Build()
+	}
+	var s flow.Snapshot
+	if err := j.store.Get(ctx, j.snapshotKey(), &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// head returns the sequence number of the last entry, or 0 if the journal is empty.
+func (j *journal) head(ctx context.Context, store kvstore.KvStore) (uint64, error) {
+	ok, err := store.Has(ctx, j.headKey())
+	if err != nil || !ok {
+		return 0, err
+	}
+	var head uint64
+	if err := store.Get(ctx, j.headKey(), &head); err != nil {
+		return 0, err
+	}
+	return head, nil
+}
+
+func (j *journal) entryKey(seq uint64) string {
+	return fmt.Sprintf("journal/%s/entries/%020d", j.flowID, seq)
+}
+
+func (j *journal) headKey() string {
+	return fmt.Sprintf("journal/%s/head", j.flowID)
+}
+
+func (j *journal) snapshotKey() string {
+	return fmt.Sprintf("journal/%s/snapshot", j.flowID)
+}
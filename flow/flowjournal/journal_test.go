@@ -0,0 +1,262 @@
+package flowjournal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+	"github.com/necrobits/x/kvstore/memstore"
+	"github.com/stretchr/testify/require"
+)
+
+type cartData struct {
+	Items int
+}
+
+type cartAction struct {
+	Kind flow.ActionType
+}
+
+func (a cartAction) Type() flow.ActionType {
+	return a.Kind
+}
+
+func cartDefinition(calls *int) *flow.Definition {
+	handle := func(ctx context.Context, data flow.FlowData, a flow.Action) (flow.Event, flow.FlowData, error) {
+		*calls++
+		cart := *data.(*cartData)
+		switch a.Type() {
+		case "AddItem":
+			cart.Items++
+			return flow.NoEvent, &cart, nil
+		case "Checkout":
+			return "CheckedOut", &cart, nil
+		}
+		return "Paid", &cart, nil
+	}
+	return &flow.Definition{
+		Type:         "Cart",
+		InitialState: "Shopping",
+		TransitionTable: flow.TransitionTable{
+			"Shopping": flow.StateConfig{
+				Handler:     handle,
+				Transitions: flow.Transitions{"CheckedOut": "Payment"},
+			},
+			"Payment": flow.StateConfig{
+				Handler:     handle,
+				After:       []flow.Timer{{Delay: 10 * time.Minute, Event: "TimedOut"}},
+				Transitions: flow.Transitions{"Paid": "Done", "TimedOut": "Canceled"},
+			},
+			"Done":     flow.StateConfig{Final: true},
+			"Canceled": flow.StateConfig{Final: true},
+		},
+		SnapshotInterval: 2,
+		DecodeData: func(data json.RawMessage) (flow.FlowData, error) {
+			cart := &cartData{}
+			return cart, json.Unmarshal(data, cart)
+		},
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("WithoutHandlers", func(t *testing.T) {
+		calls := 0
+		def := cartDefinition(&calls)
+		j := New(memstore.New(), "1")
+		f := def.New("1", &cartData{})
+		require.NoError(t, f.AttachJournal(ctx, j, def.SnapshotInterval))
+		for i := 0; i < 3; i++ {
+			require.NoError(t, f.HandleAction(ctx, cartAction{"AddItem"}))
+		}
+		require.NoError(t, f.HandleAction(ctx, cartAction{"Checkout"}))
+		require.Equal(t, 4, calls)
+
+		snapshot, err := j.LatestSnapshot(ctx)
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), snapshot.JournalSeq)
+
+		replayed, err := flow.Replay(ctx, def, j)
+		require.NoError(t, err)
+		require.Equal(t, 4, calls)
+		require.Equal(t, flow.State("Payment"), replayed.CurrentState())
+		require.Equal(t, &cartData{Items: 3}, replayed.Data())
+		require.Len(t, replayed.Deadlines(), 1)
+		require.True(t, f.Deadlines()[0].DueAt.Equal(replayed.Deadlines()[0].DueAt))
+	})
+
+	t.Run("DataPatch", func(t *testing.T) {
+		def := cartDefinition(new(int))
+		def.SnapshotInterval = 10
+		j := New(memstore.New(), "1")
+		f := def.New("1", &cartData{})
+		require.NoError(t, f.AttachJournal(ctx, j, def.SnapshotInterval))
+		require.NoError(t, f.HandleAction(ctx, cartAction{"AddItem"}))
+		require.NoError(t, f.HandleAction(ctx, cartAction{"Checkout"}))
+
+		entries, err := j.Entries(ctx, 0)
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		require.JSONEq(t, `{"Items":1}`, string(entries[0].DataPatch))
+		require.Empty(t, entries[1].DataPatch)
+		require.Equal(t, []flow.JournalStep{{
+			From:       "Shopping",
+			ActionType: "Checkout",
+			Event:      "CheckedOut",
+			To:         "Payment",
+			At:         entries[1].Steps[0].At,
+		}}, entries[1].Steps)
+	})
+
+	t.Run("FailedAction", func(t *testing.T) {
+		def := cartDefinition(new(int))
+		def.History = &flow.HistoryPolicy{}
+		j := New(memstore.New(), "1")
+		f := def.New("1", &cartData{})
+		require.NoError(t, f.AttachJournal(ctx, j, def.SnapshotInterval))
+		err := f.HandleAction(ctx, cartAction{"Pay"})
+		require.True(t, errors.Is(err, flow.ErrNoTransition))
+
+		replayed, err := flow.Replay(ctx, def, j)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), replayed.Revision())
+		require.Equal(t, f.History(), replayed.History())
+		require.Len(t, replayed.History(), 1)
+		require.NotEmpty(t, replayed.History()[0].Error)
+	})
+
+	t.Run("MigratedData", func(t *testing.T) {
+		def := cartDefinition(new(int))
+		def.SnapshotInterval = 10
+		j := New(memstore.New(), "1")
+		f := def.New("1", &cartData{})
+		require.NoError(t, f.AttachJournal(ctx, j, def.SnapshotInterval))
+		require.NoError(t, f.HandleAction(ctx, cartAction{"AddItem"}))
+		require.NoError(t, f.HandleAction(ctx, cartAction{"AddItem"}))
+
+		def.Version = 1
+		def.Migrations = []flow.Migration{{
+			From: 0,
+			To:   1,
+			Data: func(data json.RawMessage) (json.RawMessage, error) {
+				var cart cartData
+				if err := json.Unmarshal(data, &cart); err != nil {
+					return nil, err
+				}
+				cart.Items *= 10
+				return json.Marshal(cart)
+			},
+		}}
+		replayed, err := flow.Replay(ctx, def, j)
+		require.NoError(t, err)
+		require.Equal(t, &cartData{Items: 20}, replayed.Data())
+
+		require.NoError(t, replayed.HandleAction(ctx, cartAction{"AddItem"}))
+		replayed, err = flow.Replay(ctx, def, j)
+		require.NoError(t, err)
+		require.Equal(t, &cartData{Items: 21}, replayed.Data())
+	})
+
+	t.Run("FromSnapshot", func(t *testing.T) {
+		calls := 0
+		def := cartDefinition(&calls)
+		j := New(memstore.New(), "1")
+		f := def.New("1", &cartData{})
+		require.NoError(t, f.AttachJournal(ctx, j, def.SnapshotInterval))
+		for i := 0; i < 3; i++ {
+			require.NoError(t, f.HandleAction(ctx, cartAction{"AddItem"}))
+		}
+		entries, err := j.Entries(ctx, 2)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+
+		replayed, err := flow.Replay(ctx, def, j)
+		require.NoError(t, err)
+		require.Equal(t, &cartData{Items: 3}, replayed.Data())
+	})
+
+	t.Run("Tick", func(t *testing.T) {
+		calls := 0
+		def := cartDefinition(&calls)
+		j := New(memstore.New(), "1")
+		f := def.New("1", &cartData{})
+		require.NoError(t, f.AttachJournal(ctx, j, def.SnapshotInterval))
+		require.NoError(t, f.HandleAction(ctx, cartAction{"Checkout"}))
+
+		replayed, err := flow.Replay(ctx, def, j)
+		require.NoError(t, err)
+		require.NoError(t, replayed.Tick(ctx, time.Now().Add(11*time.Minute)))
+		require.Equal(t, flow.State("Canceled"), replayed.CurrentState())
+
+		replayed, err = flow.Replay(ctx, def, j)
+		require.NoError(t, err)
+		require.Equal(t, flow.State("Canceled"), replayed.CurrentState())
+		require.True(t, replayed.IsCompleted())
+		require.Empty(t, replayed.Deadlines())
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("Compensate", func(t *testing.T) {
+		calls := 0
+		def := cartDefinition(&calls)
+		def.TransitionTable["Shopping"] = flow.StateConfig{
+			Handler:     def.TransitionTable["Shopping"].Handler,
+			Transitions: def.TransitionTable["Shopping"].Transitions,
+			Compensate: func(ctx context.Context, data flow.FlowData) (flow.FlowData, error) {
+				return &cartData{}, nil
+			},
+		}
+		def.CompensatedState = "Canceled"
+		j := New(memstore.New(), "1")
+		f := def.New("1", &cartData{})
+		require.NoError(t, f.AttachJournal(ctx, j, def.SnapshotInterval))
+		require.NoError(t, f.HandleAction(ctx, cartAction{"AddItem"}))
+		require.NoError(t, f.HandleAction(ctx, cartAction{"Checkout"}))
+		require.NoError(t, f.Compensate(ctx))
+
+		replayed, err := flow.Replay(ctx, def, j)
+		require.NoError(t, err)
+		require.Equal(t, flow.State("Canceled"), replayed.CurrentState())
+		require.Equal(t, &cartData{}, replayed.Data())
+		require.Empty(t, replayed.Compensations())
+		require.False(t, replayed.IsCompensating())
+		require.True(t, replayed.IsCompleted())
+	})
+
+	t.Run("Expire", func(t *testing.T) {
+		calls := 0
+		def := cartDefinition(&calls)
+		def.ExpireIn = time.Hour
+		def.ExpirationState = "Canceled"
+		j := New(memstore.New(), "1")
+		f := def.New("1", &cartData{})
+		require.NoError(t, f.AttachJournal(ctx, j, def.SnapshotInterval))
+		require.NoError(t, f.Expire(ctx, time.Now().Add(2*time.Hour)))
+
+		replayed, err := flow.Replay(ctx, def, j)
+		require.NoError(t, err)
+		require.Equal(t, flow.State("Canceled"), replayed.CurrentState())
+		require.True(t, replayed.ExpiresAt().IsZero())
+		require.True(t, replayed.IsCompleted())
+	})
+
+	t.Run("NoSnapshot", func(t *testing.T) {
+		_, err := flow.Replay(ctx, cartDefinition(new(int)), New(memstore.New(), "1"))
+		require.True(t, errors.Is(err, ErrNoSnapshot))
+	})
+}
+
+func TestAppendOutOfOrder(t *testing.T) {
+	ctx := context.Background()
+	j := New(memstore.New(), "1")
+	require.NoError(t, j.Append(ctx, flow.JournalEntry{Seq: 1}))
+	err := j.Append(ctx, flow.JournalEntry{Seq: 3})
+	require.True(t, errors.Is(err, ErrOutOfOrder))
+	entries, err := j.Entries(ctx, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
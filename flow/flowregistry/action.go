@@ -0,0 +1,138 @@
+package flowregistry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+)
+
+const (
+	// ErrUnknownActionType is returned when an action is decoded or encoded, but its type is not registered.
+	ErrUnknownActionType = "unknown_action_type"
+	// ErrInvalidAction is returned when an encoded action is malformed, or its payload does not match its type.
+	ErrInvalidAction = "invalid_action"
+)
+
+// ActionEnvelope is the encoded form of an action, which carries its type next to its payload. For example:
+//
+//	{"type": "SendReminder", "payload": {"text": "renew"}}
+type ActionEnvelope struct {
+	Type    flow.ActionType `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// The action registry contains the actual Action struct for each ActionType,
+// so the actions received as JSON, e.g. by an HTTP handler or a queue consumer, can be decoded without a switch.
+type ActionRegistry struct {
+	actionTypes map[flow.ActionType]reflect.Type
+}
+
+func NewActionRegistry() *ActionRegistry {
+	return &ActionRegistry{
+		actionTypes: make(map[flow.ActionType]reflect.Type),
+	}
+}
+
+// Register registers the Go type of the actions with the given type. The decoded actions have the same type as the
+// given action, so if it is a pointer, pointers are decoded. Register is chainable, for example:
+//
+//	registry := flowregistry.NewActionRegistry().
+//		Register("Pay", PayAction{}).
+//		Register("Cancel", &CancelAction{})
+//
+// Like flow.New, Register panics on a misconfiguration: if the action type is empty, or the action is nil.
+func (r *ActionRegistry) Register(actionType flow.ActionType, action flow.Action) *ActionRegistry {
+	if actionType == "" {
+		panic("action type cannot be empty")
+	}
+	if action == nil {
+		panic(fmt.Sprintf("action of type %s cannot be nil", actionType))
+	}
+	r.actionTypes[actionType] = reflect.TypeOf(action)
+	return r
+}
+
+// ActionTypes returns the registered action types, sorted by name.
+func (r *ActionRegistry) ActionTypes() []flow.ActionType {
+	actionTypes := make([]flow.ActionType, 0, len(r.actionTypes))
+	for actionType := range r.actionTypes {
+		actionTypes = append(actionTypes, actionType)
+	}
+	sort.Slice(actionTypes, func(i, j int) bool {
+		return actionTypes[i] < actionTypes[j]
+	})
+	return actionTypes
+}
+
+// Unmarshal decodes the payload of an action with the given type. An empty payload decodes to the zero value of the type.
+// The decoded action must report the given type, otherwise an error with the code [ErrInvalidAction] is returned.
+func (r *ActionRegistry) Unmarshal(actionType flow.ActionType, payload json.RawMessage) (flow.Action, error) {
+	t, ok := r.actionTypes[actionType]
+	if !ok {
+		return nil, errors.B().
+			Code(ErrUnknownActionType).
+			Op("flowregistry.Unmarshal").
+			Msgf("action type %s not registered", actionType).Build()
+	}
+	decoded := reflect.New(t)
+	if t.Kind() == reflect.Pointer {
+		decoded.Elem().Set(reflect.New(t.Elem()))
+	}
+	if len(bytes.TrimSpace(payload)) > 0 {
+		if err := json.Unmarshal(payload, decoded.Interface()); err != nil {
+			return nil, errors.B().
+				Code(ErrInvalidAction).
+				Op("flowregistry.Unmarshal").
+				Msgf("invalid payload of action type %s", actionType).
+				Err(err).Build()
+		}
+	}
+	action, ok := decoded.Elem().Interface().(flow.Action)
+	if !ok || action.Type() != actionType {
+		return nil, errors.B().
+			Code(ErrInvalidAction).
+			Op("flowregistry.Unmarshal").
+			Msgf("payload of action type %s decodes to a different action type", actionType).Build()
+	}
+	return action, nil
+}
+
+// DecodeAction decodes an action from an ActionEnvelope.
+func (r *ActionRegistry) DecodeAction(raw json.RawMessage) (flow.Action, error) {
+	var envelope ActionEnvelope
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return nil, errors.B().
+			Code(ErrInvalidAction).
+			Op("flowregistry.DecodeAction").
+			Msg("malformed action envelope").
+			Err(err).Build()
+	}
+	if envelope.Type == "" {
+		return nil, errors.B().
+			Code(ErrInvalidAction).
+			Op("flowregistry.DecodeAction").
+			Msg("action envelope without type").Build()
+	}
+	return r.Unmarshal(envelope.Type, envelope.Payload)
+}
+
+// EncodeAction encodes an action as an ActionEnvelope. Only the registered action types are encoded,
+// so every encoded action can be decoded again.
+func (r *ActionRegistry) EncodeAction(action flow.Action) (json.RawMessage, error) {
+	if _, ok := r.actionTypes[action.Type()]; !ok {
+		return nil, errors.B().
+			Code(ErrUnknownActionType).
+			Op("flowregistry.EncodeAction").
+			Msgf("action type %s not registered", action.Type()).Build()
+	}
+	payload, err := json.Marshal(action)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(ActionEnvelope{Type: action.Type(), Payload: payload})
+}
@@ -0,0 +1,69 @@
+package flowregistry
+
+import (
+	"testing"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+	"github.com/stretchr/testify/require"
+)
+
+type payAction struct {
+	Amount int `json:"amount"`
+}
+
+func (a payAction) Type() flow.ActionType {
+	return "Pay"
+}
+
+type cancelAction struct {
+	Reason string `json:"reason"`
+}
+
+func (a *cancelAction) Type() flow.ActionType {
+	return "Cancel"
+}
+
+func TestActionRegistry(t *testing.T) {
+	registry := NewActionRegistry().
+		Register("Pay", payAction{}).
+		Register("Cancel", &cancelAction{})
+	require.Equal(t, []flow.ActionType{"Cancel", "Pay"}, registry.ActionTypes())
+
+	t.Run("Decode", func(t *testing.T) {
+		action, err := registry.DecodeAction([]byte(`{"type":"Pay","payload":{"amount":5}}`))
+		require.NoError(t, err)
+		require.Equal(t, payAction{Amount: 5}, action)
+
+		action, err = registry.DecodeAction([]byte(`{"type":"Cancel"}`))
+		require.NoError(t, err)
+		require.Equal(t, &cancelAction{}, action)
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		encoded, err := registry.EncodeAction(&cancelAction{Reason: "too late"})
+		require.NoError(t, err)
+		require.JSONEq(t, `{"type":"Cancel","payload":{"reason":"too late"}}`, string(encoded))
+		action, err := registry.DecodeAction(encoded)
+		require.NoError(t, err)
+		require.Equal(t, &cancelAction{Reason: "too late"}, action)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		_, err := registry.DecodeAction([]byte(`{"type":"Refund"}`))
+		require.True(t, errors.Is(err, ErrUnknownActionType))
+		_, err = registry.DecodeAction([]byte(`{"payload":{}}`))
+		require.True(t, errors.Is(err, ErrInvalidAction))
+		_, err = registry.DecodeAction([]byte(`{"type":"Pay","payload":{"amount":"five"}}`))
+		require.True(t, errors.Is(err, ErrInvalidAction))
+		_, err = NewActionRegistry().Register("Charge", payAction{}).DecodeAction([]byte(`{"type":"Charge"}`))
+		require.True(t, errors.Is(err, ErrInvalidAction))
+		_, err = NewActionRegistry().EncodeAction(payAction{})
+		require.True(t, errors.Is(err, ErrUnknownActionType))
+	})
+
+	t.Run("Register", func(t *testing.T) {
+		require.Panics(t, func() { NewActionRegistry().Register("", payAction{}) })
+		require.Panics(t, func() { NewActionRegistry().Register("Pay", nil) })
+	})
+}
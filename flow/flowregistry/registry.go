@@ -55,5 +55,10 @@ func (r *DataRegistry) DecodeSnapshot(snapshot *flow.Snapshot) (*flow.Snapshot,
 		return snapshot, err
 	}
 	snapshot.Data = flowData
+	if snapshot.Child != nil {
+		if _, err := r.DecodeSnapshot(snapshot.Child); err != nil {
+			return snapshot, err
+		}
+	}
 	return snapshot, nil
 }
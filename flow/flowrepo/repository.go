@@ -0,0 +1,209 @@
+package flowrepo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+	"github.com/necrobits/x/flow/flowregistry"
+	"github.com/necrobits/x/kvstore"
+)
+
+const (
+	// ErrFlowNotFound is returned when there is no flow with the given ID in the store.
+	ErrFlowNotFound = "flow_not_found"
+	// ErrUnknownFlowType is returned when no definition is registered for the type of a flow.
+	ErrUnknownFlowType = "unknown_flow_type"
+	// ErrStaleRevision is returned when a flow is saved, but it has been changed and saved concurrently.
+	// The flow should be loaded again, and the action retried.
+	ErrStaleRevision = "stale_revision"
+	// ErrFlowExists is returned when a new flow is created, but a flow with the same ID is already saved.
+	ErrFlowExists = "flow_exists"
+)
+
+// FlowRepository saves flows as Snapshots in a kvstore.KvStore, and restores them.
+// When a flow is loaded, its data is decoded with the data registry, the hydration hooks are called,
+// and the transition table and the options are taken from the definition registered for its type.
+type FlowRepository struct {
+	store       kvstore.KvStore
+	registry    *flowregistry.DataRegistry
+	definitions map[flow.FlowType]*flow.Definition
+}
+
+// New creates a FlowRepository using the given store and data registry.
+// If the registry is nil, the global data registry is used.
+func New(store kvstore.KvStore, registry *flowregistry.DataRegistry) *FlowRepository {
+	if registry == nil {
+		registry = flowregistry.Global()
+	}
+	return &FlowRepository{
+		store:       store,
+		registry:    registry,
+		definitions: make(map[flow.FlowType]*flow.Definition),
+	}
+}
+
+// Register registers the definition of a flow type, which is used to restore the flows of the type.
+func (r *FlowRepository) Register(def *flow.Definition) {
+	r.definitions[def.Type] = def
+}
+
+// Definition returns the registered definition of a flow type, or nil if it is not registered.
+func (r *FlowRepository) Definition(flowType flow.FlowType) *flow.Definition {
+	return r.definitions[flowType]
+}
+
+// WithStore returns a repository using the given store, and the same registry and definitions.
+// This is useful to load and save flows in a transaction of the store.
+func (r *FlowRepository) WithStore(store kvstore.KvStore) *FlowRepository {
+	return &FlowRepository{
+		store:       store,
+		registry:    r.registry,
+		definitions: r.definitions,
+	}
+}
+
+// Create saves a new flow. It fails with [ErrFlowExists], if a flow with the same ID is already saved.
+func (r *FlowRepository) Create(ctx context.Context, f *flow.Flow) error {
+	snapshot, err := f.ToSnapshot()
+	if err != nil {
+		return err
+	}
+	return r.store.Transaction(ctx, func(tx kvstore.KvStore) error {
+		ok, err := tx.Has(ctx, key(f.ID()))
+		if err != nil {
+			return err
+		}
+		if ok {
+			return errors.B().
+				Code(ErrFlowExists).
+				Op("flowrepo.Create").
+				Msgf("flow %s already exists", f.ID()).Build()
+		}
+		return tx.Set(ctx, key(f.ID()), *snapshot)
+	})
+}
+
+// Save saves the flow, replacing the previously saved snapshot with the same ID regardless of its revision.
+// Use SaveRevision to detect concurrent changes.
+func (r *FlowRepository) Save(ctx context.Context, f *flow.Flow) error {
+	snapshot, err := f.ToSnapshot()
+	if err != nil {
+		return err
+	}
+	return r.store.Set(ctx, key(f.ID()), *snapshot)
+}
+
+// SaveRevision saves the flow, if the revision of the saved snapshot is still the expected revision,
+// i.e. the revision of the flow when it was loaded. Otherwise, it fails with [ErrStaleRevision].
+// A new flow is saved with the expected revision 0. An existing flow should only be saved, if its revision has changed,
+// since a change under the same revision cannot be told apart from the saved snapshot. For example:
+//
+//	f, err := repo.Load(ctx, id)
+//	revision := f.Revision()
+//	err = f.HandleAction(ctx, action)
+//	if f.Revision() != revision {
+//		err = repo.SaveRevision(ctx, f, revision)
+//	}
+func (r *FlowRepository) SaveRevision(ctx context.Context, f *flow.Flow, revision uint64) error {
+	snapshot, err := f.ToSnapshot()
+	if err != nil {
+		return err
+	}
+	return r.store.Transaction(ctx, func(tx kvstore.KvStore) error {
+		ok, err := tx.Has(ctx, key(f.ID()))
+		if err != nil {
+			return err
+		}
+		if ok {
+			var saved flow.Snapshot
+			if err := tx.Get(ctx, key(f.ID()), &saved); err != nil {
+				return err
+			}
+			if saved.Revision != revision {
+				return errors.B().
+					Code(ErrStaleRevision).
+					Op("flowrepo.SaveRevision").
+					Msgf("flow %s has revision %d, expected %d", f.ID(), saved.Revision, revision).Build()
+			}
+		}
+		return tx.Set(ctx, key(f.ID()), *snapshot)
+	})
+}
+
+// Load restores the flow with the given ID.
+// A snapshot of a previous version of the definition is migrated before its data is decoded, see flow.Definition.Migrate.
+func (r *FlowRepository) Load(ctx context.Context, id string) (*flow.Flow, error) {
+	ok, err := r.store.Has(ctx, key(id))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.B().
+			Code(ErrFlowNotFound).
+			Op("flowrepo.Load").
+			Msgf("flow %s not found", id).Build()
+	}
+	var snapshot flow.Snapshot
+	if err := r.store.Get(ctx, key(id), &snapshot); err != nil {
+		return nil, err
+	}
+	def, ok := r.definitions[flow.FlowType(snapshot.Type)]
+	if !ok {
+		return nil, errors.B().
+			Code(ErrUnknownFlowType).
+			Op("flowrepo.Load").
+			Msgf("no definition registered for flow type %s", snapshot.Type).Build()
+	}
+	if err := def.Migrate(&snapshot); err != nil {
+		return nil, err
+	}
+	if _, err := r.registry.DecodeSnapshot(&snapshot); err != nil {
+		return nil, err
+	}
+	return def.Hydrate(ctx, &snapshot)
+}
+
+// Delete deletes the flow with the given ID. Deleting a flow, which does not exist, is not an error.
+func (r *FlowRepository) Delete(ctx context.Context, id string) error {
+	return r.store.Delete(ctx, key(id))
+}
+
+// FindExpired scans the store for the flows, which have expired at the given time, and can follow their expiration transition,
+// see flow.Flow.Expire. Completed and compensating flows are skipped, as well as the flows, whose definition has no expiration
+// transition, so they are not returned by every scan again. It returns their IDs in order.
+// Since every saved flow is read, the scan should not run too often.
+func (r *FlowRepository) FindExpired(ctx context.Context, now time.Time) ([]string, error) {
+	values := make(map[string]any)
+	if err := r.store.GetAll(ctx, values); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for k, value := range values {
+		if !strings.HasPrefix(k, keyPrefix) {
+			continue
+		}
+		var snapshot flow.Snapshot
+		if err := kvstore.Copy(value, &snapshot); err != nil {
+			return nil, err
+		}
+		if snapshot.IsCompleted || snapshot.Compensating || !snapshot.ExpiresAt.Valid || !now.After(snapshot.ExpiresAt.Time) {
+			continue
+		}
+		if def, ok := r.definitions[flow.FlowType(snapshot.Type)]; ok && (def.ExpirationEvent != "" || def.ExpirationState != "") {
+			ids = append(ids, snapshot.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+const keyPrefix = "flow/"
+
+func key(id string) string {
+	return fmt.Sprintf("%s%s", keyPrefix, id)
+}
@@ -0,0 +1,137 @@
+package flowrepo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+	"github.com/necrobits/x/flow/flowregistry"
+	"github.com/necrobits/x/kvstore/memstore"
+	"github.com/stretchr/testify/require"
+)
+
+type ticketData struct {
+	Title    string
+	Assignee string `json:"-"`
+}
+
+type ticketAction struct{}
+
+func (a ticketAction) Type() flow.ActionType {
+	return "Resolve"
+}
+
+func ticketDefinition() *flow.Definition {
+	return &flow.Definition{
+		Type:         "Ticket",
+		InitialState: "Open",
+		TransitionTable: flow.TransitionTable{
+			"Open": flow.StateConfig{
+				Transitions: flow.Transitions{"Resolved": "Closed"},
+			},
+			"Closed": flow.StateConfig{Final: true},
+		},
+		Handler: func(ctx context.Context, data flow.FlowData, a flow.Action) (flow.Event, flow.FlowData, error) {
+			return "Resolved", data, nil
+		},
+	}
+}
+
+func TestFlowRepository(t *testing.T) {
+	ctx := context.Background()
+	registry := flowregistry.NewDataRegistry()
+	registry.Register("Ticket", ticketData{})
+	flow.HookRegistry().RegisterHydration("Ticket", flow.TypedHydrationHook(func(d *ticketData) (*ticketData, error) {
+		d.Assignee = "support"
+		return d, nil
+	}))
+	newRepository := func() *FlowRepository {
+		repo := New(memstore.New(), registry)
+		repo.Register(ticketDefinition())
+		return repo
+	}
+
+	t.Run("SaveAndLoad", func(t *testing.T) {
+		repo := newRepository()
+		f := ticketDefinition().New("1", &ticketData{Title: "Broken login"})
+		require.NoError(t, repo.Save(ctx, f))
+
+		loaded, err := repo.Load(ctx, "1")
+		require.NoError(t, err)
+		require.Equal(t, flow.State("Open"), loaded.CurrentState())
+		require.Equal(t, &ticketData{Title: "Broken login", Assignee: "support"}, loaded.Data())
+
+		require.NoError(t, loaded.HandleAction(ctx, ticketAction{}))
+		require.NoError(t, repo.Save(ctx, loaded))
+		loaded, err = repo.Load(ctx, "1")
+		require.NoError(t, err)
+		require.Equal(t, flow.State("Closed"), loaded.CurrentState())
+		require.True(t, loaded.IsCompleted())
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		repo := newRepository()
+		legacy := ticketDefinition()
+		legacy.TransitionTable = flow.TransitionTable{
+			"New": flow.StateConfig{
+				Transitions: flow.Transitions{"Resolved": "Closed"},
+			},
+			"Closed": flow.StateConfig{Final: true},
+		}
+		legacy.InitialState = "New"
+		require.NoError(t, repo.Save(ctx, legacy.New("1", &ticketData{Title: "Broken login"})))
+
+		_, err := repo.Load(ctx, "1")
+		require.True(t, errors.Is(err, flow.ErrNoMigrationPath))
+
+		def := ticketDefinition()
+		def.Version = 1
+		def.Migrations = []flow.Migration{{From: 0, To: 1, States: map[flow.State]flow.State{"New": "Open"}}}
+		repo.Register(def)
+		loaded, err := repo.Load(ctx, "1")
+		require.NoError(t, err)
+		require.Equal(t, flow.State("Open"), loaded.CurrentState())
+		require.Equal(t, &ticketData{Title: "Broken login", Assignee: "support"}, loaded.Data())
+	})
+
+	t.Run("StaleRevision", func(t *testing.T) {
+		repo := newRepository()
+		require.NoError(t, repo.SaveRevision(ctx, ticketDefinition().New("1", &ticketData{}), 0))
+		first, err := repo.Load(ctx, "1")
+		require.NoError(t, err)
+		second, err := repo.Load(ctx, "1")
+		require.NoError(t, err)
+
+		require.NoError(t, first.HandleAction(ctx, ticketAction{}))
+		require.Equal(t, uint64(1), first.Revision())
+		require.NoError(t, repo.SaveRevision(ctx, first, 0))
+
+		require.NoError(t, second.HandleAction(ctx, ticketAction{}))
+		err = repo.SaveRevision(ctx, second, 0)
+		require.True(t, errors.Is(err, ErrStaleRevision))
+		loaded, err := repo.Load(ctx, "1")
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), loaded.Revision())
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		_, err := newRepository().Load(ctx, "1")
+		require.True(t, errors.Is(err, ErrFlowNotFound))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		repo := newRepository()
+		require.NoError(t, repo.Save(ctx, ticketDefinition().New("1", &ticketData{})))
+		require.NoError(t, repo.Delete(ctx, "1"))
+		_, err := repo.Load(ctx, "1")
+		require.True(t, errors.Is(err, ErrFlowNotFound))
+	})
+
+	t.Run("UnknownFlowType", func(t *testing.T) {
+		repo := New(memstore.New(), registry)
+		require.NoError(t, repo.Save(ctx, ticketDefinition().New("1", &ticketData{})))
+		_, err := repo.Load(ctx, "1")
+		require.True(t, errors.Is(err, ErrUnknownFlowType))
+	})
+}
@@ -0,0 +1,429 @@
+// Package flowscheduler delivers actions to flows at a later time, e.g. "send a reminder to flow X in 24h".
+// The scheduled actions are persisted in a kvstore.KvStore, so they survive restarts.
+// They are encoded as action envelopes by a flowregistry.ActionRegistry, so their types have to be registered.
+package flowscheduler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+	"github.com/necrobits/x/flow/flowregistry"
+	"github.com/necrobits/x/flow/flowrepo"
+	"github.com/necrobits/x/kvstore"
+)
+
+const (
+	// ErrInvalidSchedule is returned when an action is scheduled without a key or a flow ID.
+	ErrInvalidSchedule = "invalid_schedule"
+)
+
+const (
+	// DefaultRetryDelay is the default delay, after which the delivery of an action is retried.
+	DefaultRetryDelay = time.Minute
+	// DefaultMaxAttempts is the default number of deliveries of an action, before it is moved to the dead letters.
+	DefaultMaxAttempts = 10
+)
+
+// Dispatcher handles an action for a persisted flow, e.g. a flowengine.Engine.
+// The flow is returned, if the action has been handled, even if it has failed. Otherwise, it is nil.
+type Dispatcher interface {
+	Dispatch(ctx context.Context, flowID string, action flow.Action) (*flow.Flow, error)
+}
+
+// Entry is a scheduled action.
+type Entry struct {
+	// Key identifies the entry. Scheduling an action with the same key replaces the entry.
+	Key string `json:"key"`
+	// FlowID is the ID of the flow, which receives the action.
+	FlowID string `json:"flow_id"`
+	// ActionType is the type of the action.
+	ActionType flow.ActionType `json:"action_type"`
+	// EncodedAction is the action encoded as a flowregistry.ActionEnvelope.
+	EncodedAction json.RawMessage `json:"action"`
+	// DueAt is the time at which the action is delivered.
+	DueAt time.Time `json:"due_at"`
+	// Attempts is the number of failed deliveries.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// DeadLetter is a scheduled action, whose delivery has failed permanently.
+type DeadLetter struct {
+	Entry
+	// Error is the error of the last delivery.
+	Error string `json:"error"`
+	// FailedAt is the time of the last delivery.
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// PollResult is the outcome of a single poll.
+type PollResult struct {
+	// Delivered contains the keys of the entries, whose actions have been handled successfully.
+	Delivered []string
+	// Failed contains the errors of the entries, which could not be delivered, or whose actions have failed.
+	// An action, which has not been handled, e.g. because the flow could not be saved, is retried after the retry delay.
+	// An action, which has been handled, but failed, is not retried.
+	Failed map[string]error
+	// DeadLettered contains the keys of the failed entries, which have been moved to the dead letters, see Scheduler.DeadLetters.
+	DeadLettered []string
+}
+
+// Scheduler stores actions, and delivers them to their flows when they are due.
+// The delivery is at-least-once: an entry is only removed after its action has been handled,
+// so if the process stops in between, the action is delivered again after the restart.
+// The actions should be idempotent, or the handlers should detect repeated actions.
+//
+// The due entries are delivered by Poll, or periodically by Run. Only a single scheduler should poll the same store.
+//
+// An entry, whose delivery fails permanently, is moved to the dead letters instead of being retried:
+// if its action cannot be decoded, e.g. because its type is not registered anymore, if its flow does not exist or has an unknown type, if its action has been handled,
+// but failed, e.g. because the flow is completed, or if it has been delivered the maximum number of attempts.
+type Scheduler struct {
+	store       kvstore.KvStore
+	dispatcher  Dispatcher
+	actions     *flowregistry.ActionRegistry
+	clock       func() time.Time
+	retryDelay  time.Duration
+	maxAttempts int
+}
+
+// New creates a Scheduler, which persists the actions in the store, and delivers them to the dispatcher.
+// The actions are encoded and decoded by the action registry.
+func New(store kvstore.KvStore, dispatcher Dispatcher, actions *flowregistry.ActionRegistry) *Scheduler {
+	return &Scheduler{
+		store:       store,
+		dispatcher:  dispatcher,
+		actions:     actions,
+		clock:       time.Now,
+		retryDelay:  DefaultRetryDelay,
+		maxAttempts: DefaultMaxAttempts,
+	}
+}
+
+// WithClock sets the clock, which decides when an action is due. This is useful for tests.
+func (s *Scheduler) WithClock(clock func() time.Time) *Scheduler {
+	s.clock = clock
+	return s
+}
+
+// WithRetryDelay sets the delay, after which the delivery of an action is retried. Defaults to [DefaultRetryDelay].
+func (s *Scheduler) WithRetryDelay(delay time.Duration) *Scheduler {
+	s.retryDelay = delay
+	return s
+}
+
+// WithMaxAttempts sets the number of deliveries of an action, after which it is moved to the dead letters.
+// Defaults to [DefaultMaxAttempts]. If it is zero or less, the deliveries are retried until they succeed.
+func (s *Scheduler) WithMaxAttempts(attempts int) *Scheduler {
+	s.maxAttempts = attempts
+	return s
+}
+
+// Schedule schedules an action for the flow at the given time.
+// If an action is already scheduled with the same key, it is replaced.
+// If the type of the action is not registered, an error with the code flowregistry.ErrUnknownActionType is returned.
+func (s *Scheduler) Schedule(ctx context.Context, key string, flowID string, action flow.Action, dueAt time.Time) error {
+	if key == "" || flowID == "" {
+		return errors.B().
+			Code(ErrInvalidSchedule).
+			Op("flowscheduler.Schedule").
+			Msg("key and flow ID must not be empty").Build()
+	}
+	encoded, err := s.actions.EncodeAction(action)
+	if err != nil {
+		return err
+	}
+	return s.store.Transaction(ctx, func(tx kvstore.KvStore) error {
+		if err := tx.Set(ctx, entryKey(key), Entry{
+			Key:           key,
+			FlowID:        flowID,
+			ActionType:    action.Type(),
+			EncodedAction: encoded,
+			DueAt:         dueAt,
+		}); err != nil {
+			return err
+		}
+		return updateIndex(ctx, tx, key, true)
+	})
+}
+
+// ScheduleIn schedules an action for the flow after the given delay, see Schedule.
+func (s *Scheduler) ScheduleIn(ctx context.Context, key string, flowID string, action flow.Action, delay time.Duration) error {
+	return s.Schedule(ctx, key, flowID, action, s.clock().Add(delay))
+}
+
+// Cancel removes the scheduled action with the given key. Canceling an action, which is not scheduled, is not an error.
+func (s *Scheduler) Cancel(ctx context.Context, key string) error {
+	return s.store.Transaction(ctx, func(tx kvstore.KvStore) error {
+		if err := tx.Delete(ctx, entryKey(key)); err != nil {
+			return err
+		}
+		return updateIndex(ctx, tx, key, false)
+	})
+}
+
+// Pending returns the scheduled actions, ordered by their due time.
+// The entries are found by an index of their keys, which is stored next to them, so the rest of the store is not read.
+func (s *Scheduler) Pending(ctx context.Context) ([]Entry, error) {
+	keys, err := readIndex(ctx, s.store)
+	if err != nil {
+		return nil, err
+	}
+	entryKeys := make([]string, len(keys))
+	for i, key := range keys {
+		entryKeys[i] = entryKey(key)
+	}
+	values := make(map[string]any)
+	if err := s.store.GetMany(ctx, entryKeys, values); err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, value := range values {
+		var entry Entry
+		if err := kvstore.Copy(value, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].DueAt.Equal(entries[j].DueAt) {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].DueAt.Before(entries[j].DueAt)
+	})
+	return entries, nil
+}
+
+// Poll delivers the actions, which are due at the current time of the clock, in the order of their due time.
+// A failed delivery does not stop the poll, its error is reported in the result instead.
+func (s *Scheduler) Poll(ctx context.Context) (*PollResult, error) {
+	now := s.clock()
+	entries, err := s.Pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := &PollResult{Failed: make(map[string]error)}
+	for _, entry := range entries {
+		if entry.DueAt.After(now) {
+			break
+		}
+		deadLettered, err := s.deliver(ctx, entry, now)
+		if err != nil {
+			result.Failed[entry.Key] = err
+		} else {
+			result.Delivered = append(result.Delivered, entry.Key)
+		}
+		if deadLettered {
+			result.DeadLettered = append(result.DeadLettered, entry.Key)
+		}
+	}
+	return result, nil
+}
+
+// DeadLetters returns the actions, whose delivery has failed permanently, ordered by their key.
+// Since every key of the store is read, it should not be called too often. They are kept until they are deleted with DeleteDeadLetter, e.g. after they have been inspected, or scheduled again.
+func (s *Scheduler) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	values := make(map[string]any)
+	if err := s.store.GetAll(ctx, values); err != nil {
+		return nil, err
+	}
+	var letters []DeadLetter
+	for k, value := range values {
+		if !strings.HasPrefix(k, deadLetterPrefix) {
+			continue
+		}
+		var letter DeadLetter
+		if err := kvstore.Copy(value, &letter); err != nil {
+			return nil, err
+		}
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Key < letters[j].Key })
+	return letters, nil
+}
+
+// DeleteDeadLetter deletes the dead letter with the given key. Deleting a dead letter, which does not exist, is not an error.
+func (s *Scheduler) DeleteDeadLetter(ctx context.Context, key string) error {
+	return s.store.Delete(ctx, deadLetterKey(key))
+}
+
+// Run polls the store every interval, until the context is done.
+func (s *Scheduler) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.Poll(ctx); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliver dispatches the action of an entry. The entry is removed, if the action has been handled successfully.
+// If the delivery has failed permanently, the entry is moved to the dead letters, and deliver reports it.
+// Otherwise, the delivery is retried after the retry delay.
+func (s *Scheduler) deliver(ctx context.Context, entry Entry, now time.Time) (bool, error) {
+	action, err := s.actions.DecodeAction(entry.EncodedAction)
+	if err != nil {
+		return s.deadLetter(ctx, entry, now, err)
+	}
+	f, err := s.dispatcher.Dispatch(ctx, entry.FlowID, action)
+	switch {
+	case err == nil:
+		return false, s.remove(ctx, entry)
+	case f != nil || isPermanent(err):
+		return s.deadLetter(ctx, entry, now, err)
+	case s.maxAttempts > 0 && entry.Attempts+1 >= s.maxAttempts:
+		return s.deadLetter(ctx, entry, now, err)
+	}
+	return false, s.retry(ctx, entry, now, err)
+}
+
+// isPermanent reports whether a failed dispatch would fail again, if it was retried.
+func isPermanent(err error) bool {
+	return errors.Is(err, flowrepo.ErrFlowNotFound) || errors.Is(err, flowrepo.ErrUnknownFlowType)
+}
+
+// retry postpones the delivery of an entry, unless it has been replaced or canceled in the meantime.
+func (s *Scheduler) retry(ctx context.Context, entry Entry, now time.Time, cause error) error {
+	err := s.store.Transaction(ctx, func(tx kvstore.KvStore) error {
+		ok, err := s.isScheduled(ctx, tx, entry)
+		if err != nil || !ok {
+			return err
+		}
+		entry.Attempts++
+		entry.DueAt = now.Add(s.retryDelay)
+		return tx.Set(ctx, entryKey(entry.Key), entry)
+	})
+	if err != nil {
+		return err
+	}
+	return errors.B().
+		Op("flowscheduler.Poll").
+		Msgf("delivery of %s to flow %s failed", entry.ActionType, entry.FlowID).
+		Err(cause).Build()
+}
+
+// deadLetter moves an entry to the dead letters, unless it has been replaced or canceled in the meantime.
+// It reports whether the entry has been moved.
+func (s *Scheduler) deadLetter(ctx context.Context, entry Entry, now time.Time, cause error) (bool, error) {
+	moved := false
+	err := s.store.Transaction(ctx, func(tx kvstore.KvStore) error {
+		ok, err := s.isScheduled(ctx, tx, entry)
+		if err != nil || !ok {
+			return err
+		}
+		if err := tx.Delete(ctx, entryKey(entry.Key)); err != nil {
+			return err
+		}
+		if err := updateIndex(ctx, tx, entry.Key, false); err != nil {
+			return err
+		}
+		entry.Attempts++
+		moved = true
+		return tx.Set(ctx, deadLetterKey(entry.Key), DeadLetter{
+			Entry:    entry,
+			Error:    cause.Error(),
+			FailedAt: now,
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+	return moved, errors.B().
+		Op("flowscheduler.Poll").
+		Msgf("delivery of %s to flow %s failed permanently", entry.ActionType, entry.FlowID).
+		Err(cause).Build()
+}
+
+// remove removes a delivered entry, unless it has been replaced in the meantime.
+func (s *Scheduler) remove(ctx context.Context, entry Entry) error {
+	return s.store.Transaction(ctx, func(tx kvstore.KvStore) error {
+		ok, err := s.isScheduled(ctx, tx, entry)
+		if err != nil || !ok {
+			return err
+		}
+		if err := tx.Delete(ctx, entryKey(entry.Key)); err != nil {
+			return err
+		}
+		return updateIndex(ctx, tx, entry.Key, false)
+	})
+}
+
+// isScheduled reports whether the entry is still stored unchanged.
+func (s *Scheduler) isScheduled(ctx context.Context, tx kvstore.KvStore, entry Entry) (bool, error) {
+	ok, err := tx.Has(ctx, entryKey(entry.Key))
+	if err != nil || !ok {
+		return false, err
+	}
+	var stored Entry
+	if err := tx.Get(ctx, entryKey(entry.Key), &stored); err != nil {
+		return false, err
+	}
+	return stored.FlowID == entry.FlowID &&
+		stored.ActionType == entry.ActionType &&
+		bytes.Equal(stored.EncodedAction, entry.EncodedAction) &&
+		stored.DueAt.Equal(entry.DueAt) &&
+		stored.Attempts == entry.Attempts, nil
+}
+
+// readIndex returns the keys of the scheduled entries, in order.
+func readIndex(ctx context.Context, store kvstore.KvStore) ([]string, error) {
+	ok, err := store.Has(ctx, indexKey)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var keys []string
+	if err := store.Get(ctx, indexKey, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// updateIndex adds the key of an entry to the index, or removes it, within a transaction.
+func updateIndex(ctx context.Context, tx kvstore.KvStore, key string, scheduled bool) error {
+	keys, err := readIndex(ctx, tx)
+	if err != nil {
+		return err
+	}
+	i := sort.SearchStrings(keys, key)
+	indexed := i < len(keys) && keys[i] == key
+	if scheduled == indexed {
+		return nil
+	}
+	// The stored index is not changed in place, since a store may return the stored value itself.
+	updated := make([]string, 0, len(keys)+1)
+	updated = append(updated, keys[:i]...)
+	if scheduled {
+		updated = append(updated, key)
+	} else {
+		i++
+	}
+	updated = append(updated, keys[i:]...)
+	return tx.Set(ctx, indexKey, updated)
+}
+
+const (
+	entryPrefix      = "schedule/"
+	deadLetterPrefix = "deadletter/"
+	// indexKey is the key of the index of the scheduled entries. It does not start with entryPrefix, so it cannot collide with an entry.
+	indexKey = "schedule-index"
+)
+
+func entryKey(key string) string {
+	return fmt.Sprintf("%s%s", entryPrefix, key)
+}
+
+func deadLetterKey(key string) string {
+	return fmt.Sprintf("%s%s", deadLetterPrefix, key)
+}
@@ -0,0 +1,231 @@
+package flowscheduler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/necrobits/x/errors"
+	"github.com/necrobits/x/flow"
+	"github.com/necrobits/x/flow/flowengine"
+	"github.com/necrobits/x/flow/flowregistry"
+	"github.com/necrobits/x/flow/flowrepo"
+	"github.com/necrobits/x/kvstore"
+	"github.com/necrobits/x/kvstore/memstore"
+	"github.com/stretchr/testify/require"
+)
+
+var _ Dispatcher = (*flowengine.Engine)(nil)
+
+type subscriptionData struct {
+	Reminders []string
+}
+
+type sendReminder struct {
+	Text string
+}
+
+func (a sendReminder) Type() flow.ActionType {
+	return "SendReminder"
+}
+
+var actions = flowregistry.NewActionRegistry().Register("SendReminder", sendReminder{})
+
+func newEngine(store kvstore.KvStore) *flowengine.Engine {
+	registry := flowregistry.NewDataRegistry()
+	registry.Register("Subscription", subscriptionData{})
+	e := flowengine.New(store, registry)
+	e.Register(&flow.Definition{
+		Type:         "Subscription",
+		InitialState: "Active",
+		TransitionTable: flow.TransitionTable{
+			"Active": flow.StateConfig{
+				Handler: func(ctx context.Context, data flow.FlowData, a flow.Action) (flow.Event, flow.FlowData, error) {
+					subscription := *data.(*subscriptionData)
+					subscription.Reminders = append(subscription.Reminders, a.(sendReminder).Text)
+					return flow.NoEvent, &subscription, nil
+				},
+			},
+		},
+	})
+	return e
+}
+
+// flakyDispatcher fails to dispatch the first actions, like a store which is temporarily unavailable.
+type flakyDispatcher struct {
+	Dispatcher
+	failures int
+}
+
+func (d *flakyDispatcher) Dispatch(ctx context.Context, flowID string, action flow.Action) (*flow.Flow, error) {
+	if d.failures > 0 {
+		d.failures--
+		return nil, fmt.Errorf("store unavailable")
+	}
+	return d.Dispatcher.Dispatch(ctx, flowID, action)
+}
+
+func TestScheduler(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now()
+	setup := func(t *testing.T) (*flowengine.Engine, kvstore.KvStore, *time.Time) {
+		store := memstore.New()
+		e := newEngine(store)
+		_, err := e.Create(ctx, "Subscription", "1", &subscriptionData{})
+		require.NoError(t, err)
+		now := start
+		return e, store, &now
+	}
+	reminders := func(t *testing.T, e *flowengine.Engine) []string {
+		f, err := e.Load(ctx, "1")
+		require.NoError(t, err)
+		return f.Data().(*subscriptionData).Reminders
+	}
+
+	t.Run("Deliver", func(t *testing.T) {
+		e, store, now := setup(t)
+		s := New(store, e, actions).WithClock(func() time.Time { return *now })
+		require.NoError(t, s.ScheduleIn(ctx, "reminder/1", "1", sendReminder{"renew"}, 24*time.Hour))
+		require.NoError(t, s.ScheduleIn(ctx, "reminder/2", "1", sendReminder{"expiring"}, 48*time.Hour))
+
+		result, err := s.Poll(ctx)
+		require.NoError(t, err)
+		require.Empty(t, result.Delivered)
+
+		*now = start.Add(48 * time.Hour)
+		result, err = s.Poll(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"reminder/1", "reminder/2"}, result.Delivered)
+		require.Equal(t, []string{"renew", "expiring"}, reminders(t, e))
+		pending, err := s.Pending(ctx)
+		require.NoError(t, err)
+		require.Empty(t, pending)
+	})
+
+	t.Run("CancelAndReplace", func(t *testing.T) {
+		e, store, now := setup(t)
+		s := New(store, e, actions).WithClock(func() time.Time { return *now })
+		require.NoError(t, s.ScheduleIn(ctx, "reminder/1", "1", sendReminder{"first"}, time.Hour))
+		require.NoError(t, s.ScheduleIn(ctx, "reminder/1", "1", sendReminder{"replaced"}, time.Hour))
+		require.NoError(t, s.ScheduleIn(ctx, "reminder/2", "1", sendReminder{"canceled"}, time.Hour))
+		require.NoError(t, s.Cancel(ctx, "reminder/2"))
+
+		*now = start.Add(time.Hour)
+		_, err := s.Poll(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"replaced"}, reminders(t, e))
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		e, store, now := setup(t)
+		dispatcher := &flakyDispatcher{Dispatcher: e, failures: 1}
+		s := New(store, dispatcher, actions).
+			WithClock(func() time.Time { return *now }).
+			WithRetryDelay(time.Minute)
+		require.NoError(t, s.Schedule(ctx, "reminder/1", "1", sendReminder{"renew"}, start))
+
+		result, err := s.Poll(ctx)
+		require.NoError(t, err)
+		require.Error(t, result.Failed["reminder/1"])
+		pending, err := s.Pending(ctx)
+		require.NoError(t, err)
+		require.Len(t, pending, 1)
+		require.Equal(t, 1, pending[0].Attempts)
+		require.True(t, pending[0].DueAt.Equal(start.Add(time.Minute)))
+
+		// A new scheduler on the same store continues after a restart.
+		*now = start.Add(time.Minute)
+		result, err = New(store, e, actions).WithClock(func() time.Time { return *now }).Poll(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []string{"reminder/1"}, result.Delivered)
+		require.Equal(t, []string{"renew"}, reminders(t, e))
+	})
+
+	t.Run("MaxAttempts", func(t *testing.T) {
+		e, store, now := setup(t)
+		dispatcher := &flakyDispatcher{Dispatcher: e, failures: 2}
+		s := New(store, dispatcher, actions).
+			WithClock(func() time.Time { return *now }).
+			WithRetryDelay(time.Minute).
+			WithMaxAttempts(2)
+		require.NoError(t, s.Schedule(ctx, "reminder/1", "1", sendReminder{"renew"}, start))
+
+		result, err := s.Poll(ctx)
+		require.NoError(t, err)
+		require.Empty(t, result.DeadLettered)
+
+		*now = start.Add(time.Minute)
+		result, err = s.Poll(ctx)
+		require.NoError(t, err)
+		require.Error(t, result.Failed["reminder/1"])
+		require.Equal(t, []string{"reminder/1"}, result.DeadLettered)
+		pending, err := s.Pending(ctx)
+		require.NoError(t, err)
+		require.Empty(t, pending)
+		letters, err := s.DeadLetters(ctx)
+		require.NoError(t, err)
+		require.Len(t, letters, 1)
+		require.Equal(t, 2, letters[0].Attempts)
+		require.Equal(t, "store unavailable", letters[0].Error)
+
+		require.NoError(t, s.DeleteDeadLetter(ctx, "reminder/1"))
+		letters, err = s.DeadLetters(ctx)
+		require.NoError(t, err)
+		require.Empty(t, letters)
+	})
+
+	t.Run("FlowNotFound", func(t *testing.T) {
+		e, store, now := setup(t)
+		s := New(store, e, actions).WithClock(func() time.Time { return *now })
+		require.NoError(t, s.Schedule(ctx, "reminder/1", "2", sendReminder{"renew"}, start))
+		result, err := s.Poll(ctx)
+		require.NoError(t, err)
+		require.True(t, errors.Is(result.Failed["reminder/1"], flowrepo.ErrFlowNotFound))
+		require.Equal(t, []string{"reminder/1"}, result.DeadLettered)
+		pending, err := s.Pending(ctx)
+		require.NoError(t, err)
+		require.Empty(t, pending)
+	})
+
+	t.Run("UnknownActionType", func(t *testing.T) {
+		e, store, now := setup(t)
+		s := New(store, e, actions).WithClock(func() time.Time { return *now })
+		require.NoError(t, s.Schedule(ctx, "reminder/1", "1", sendReminder{"renew"}, start))
+		s.actions = flowregistry.NewActionRegistry()
+		result, err := s.Poll(ctx)
+		require.NoError(t, err)
+		require.True(t, errors.Is(result.Failed["reminder/1"], flowregistry.ErrUnknownActionType))
+		letters, err := s.DeadLetters(ctx)
+		require.NoError(t, err)
+		require.Len(t, letters, 1)
+		require.Equal(t, flow.ActionType("SendReminder"), letters[0].ActionType)
+
+		err = s.Schedule(ctx, "reminder/2", "1", sendReminder{"renew"}, start)
+		require.True(t, errors.Is(err, flowregistry.ErrUnknownActionType))
+	})
+
+	t.Run("Index", func(t *testing.T) {
+		e, store, now := setup(t)
+		s := New(store, e, actions).WithClock(func() time.Time { return *now })
+		require.NoError(t, store.Set(ctx, "schedule/unindexed", Entry{Key: "unindexed", FlowID: "1"}))
+		require.NoError(t, s.ScheduleIn(ctx, "reminder/2", "1", sendReminder{"later"}, time.Hour))
+		require.NoError(t, s.ScheduleIn(ctx, "reminder/1", "1", sendReminder{"sooner"}, time.Minute))
+		require.NoError(t, s.ScheduleIn(ctx, "reminder/1", "1", sendReminder{"sooner"}, time.Minute))
+		var keys []string
+		require.NoError(t, store.Get(ctx, indexKey, &keys))
+		require.Equal(t, []string{"reminder/1", "reminder/2"}, keys)
+
+		pending, err := s.Pending(ctx)
+		require.NoError(t, err)
+		require.Len(t, pending, 2)
+		require.Equal(t, "reminder/1", pending[0].Key)
+
+		require.NoError(t, s.Cancel(ctx, "reminder/2"))
+		*now = start.Add(time.Minute)
+		_, err = s.Poll(ctx)
+		require.NoError(t, err)
+		require.NoError(t, store.Get(ctx, indexKey, &keys))
+		require.Empty(t, keys)
+	})
+}
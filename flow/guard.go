@@ -0,0 +1,60 @@
+package flow
+
+import "context"
+
+// Guard is a predicate, which decides whether a guarded transition can be taken.
+// It receives the data returned by the action handler.
+type Guard func(ctx context.Context, data FlowData) bool
+
+// GuardedTarget is a candidate target of an event, which is only taken if its guard passes.
+type GuardedTarget struct {
+	// Target is the next state, if the guard passes.
+	Target State
+	// Guard is the predicate of the transition. A nil guard always passes,
+	// so it can be used as a fallback at the end of the candidates.
+	Guard Guard
+	// Name is a short description of the guard. It is used for visualization.
+	Name string
+}
+
+// GuardedTransitions is a map, describing the ordered candidate targets for each event.
+// The candidates are evaluated in order, and the first one whose guard passes is taken.
+// For example:
+//
+//	flow.GuardedTransitions{
+//		OrderPaid: {
+//			{Target: ManualReview, Guard: flow.TypedGuard(isLargeOrder), Name: "large order"},
+//			{Target: AwaitingShipping},
+//		},
+//	}
+type GuardedTransitions map[Event][]GuardedTarget
+
+// TypedGuard creates a guard for a specific data type.
+// If the data is not of the given type, the guard does not pass.
+func TypedGuard[D FlowData](guard func(D) bool) Guard {
+	return func(ctx context.Context, data FlowData) bool {
+		castedData, ok := data.(D)
+		if !ok {
+			return false
+		}
+		return guard(castedData)
+	}
+}
+
+// evaluateGuards returns the target of the first candidate whose guard passes.
+// If a guard panics, the evaluation stops with an error.
+func evaluateGuards(ctx context.Context, event Event, candidates []GuardedTarget, data FlowData) (State, bool, error) {
+	for _, candidate := range candidates {
+		if candidate.Guard == nil {
+			return candidate.Target, true, nil
+		}
+		passed, err := callGuard(ctx, event, candidate.Guard, data)
+		if err != nil {
+			return "", false, err
+		}
+		if passed {
+			return candidate.Target, true, nil
+		}
+	}
+	return "", false, nil
+}
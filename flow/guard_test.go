@@ -0,0 +1,55 @@
+package flow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/necrobits/x/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuardedTransitions(t *testing.T) {
+	isLarge := TypedGuard(func(d *orderData) bool { return d.Amount >= 1000 })
+	isSmall := TypedGuard(func(d *orderData) bool { return d.Amount < 10 })
+	table := TransitionTable{
+		"AwaitingPayment": StateConfig{
+			Handler: emit("Paid"),
+			GuardedTransitions: GuardedTransitions{
+				"Paid": {
+					{Target: "ManualReview", Guard: isLarge, Name: "large order"},
+					{Target: "Shipping"},
+				},
+			},
+		},
+		"Strict": StateConfig{
+			Handler: emit("Paid"),
+			GuardedTransitions: GuardedTransitions{
+				"Paid": {
+					{Target: "ManualReview", Guard: isLarge},
+					{Target: "Shipping", Guard: isSmall},
+				},
+			},
+		},
+		"ManualReview": StateConfig{Final: true},
+		"Shipping":     StateConfig{Final: true},
+	}
+	t.Run("FirstPassingGuard", func(t *testing.T) {
+		f := newTestFlow(table, "AwaitingPayment", &orderData{Amount: 5000})
+		require.NoError(t, f.HandleAction(context.Background(), testAction{"Pay"}))
+		require.Equal(t, State("ManualReview"), f.CurrentState())
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		f := newTestFlow(table, "AwaitingPayment", &orderData{Amount: 50})
+		require.NoError(t, f.HandleAction(context.Background(), testAction{"Pay"}))
+		require.Equal(t, State("Shipping"), f.CurrentState())
+	})
+
+	t.Run("NoPassingGuard", func(t *testing.T) {
+		f := newTestFlow(table, "Strict", &orderData{Amount: 50})
+		err := f.HandleAction(context.Background(), testAction{"Pay"})
+		require.True(t, errors.Is(err, ErrNoPassingGuard))
+		require.Equal(t, State("Strict"), f.CurrentState())
+		require.False(t, f.IsCompleted())
+	})
+}
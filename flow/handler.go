@@ -3,6 +3,9 @@ package flow
 import (
 	"context"
 	"fmt"
+	"sort"
+
+	"github.com/necrobits/x/errors"
 )
 
 type typedActionHandler[D FlowData, A Action] func(ctx context.Context, data D, a A) (Event, D, error)
@@ -58,7 +61,8 @@ func TypedHandler[D FlowData, A Action](f typedActionHandler[D, A]) ActionHandle
 //		},
 //	}
 type actionRouter struct {
-	routes ActionRoutes
+	routes      ActionRoutes
+	middlewares []Middleware
 }
 
 // NewRouter creates a new ActionRouter.
@@ -71,9 +75,19 @@ func NewRouter(routes ActionRoutes) *actionRouter {
 // You should not call this method directly, instead you should use the router as a handler.
 func (r *actionRouter) Handle(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
 	if handler, ok := r.routes[a.Type()]; ok {
-		return handler(ctx, data, a)
+		return applyMiddlewares(handler, r.middlewares)(ctx, data, a)
 	}
-	return "", data, fmt.Errorf("no handler for action type: %s", a.Type())
+	return "", data, errors.B().
+		Code(ErrNoRoute).
+		Op("flow.Router").
+		Msgf("no handler for action type: %s", a.Type()).Build()
+}
+
+// Use adds middlewares to the router, which wrap the handler of every route, see [Middleware].
+// An action without a route is not passed to the middlewares.
+func (r *actionRouter) Use(middlewares ...Middleware) *actionRouter {
+	r.middlewares = append(r.middlewares, middlewares...)
+	return r
 }
 
 // AddRoute adds a route to the router.
@@ -88,6 +102,17 @@ func (r *actionRouter) AddRoutes(routes ActionRoutes) {
 	}
 }
 
+// ActionTypes returns the action types, which have a route, sorted by name.
+// It can be used to declare the actions of a state, see [StateConfig.Actions].
+func (r *actionRouter) ActionTypes() []ActionType {
+	actionTypes := make([]ActionType, 0, len(r.routes))
+	for actionType := range r.routes {
+		actionTypes = append(actionTypes, actionType)
+	}
+	sort.Slice(actionTypes, func(i, j int) bool { return actionTypes[i] < actionTypes[j] })
+	return actionTypes
+}
+
 // ToHandler converts the router to a single handler.
 // You should call this method after adding all the routes to convert the router to a handler.
 func (r *actionRouter) ToHandler() ActionHandler {
@@ -0,0 +1,38 @@
+package flow
+
+import "context"
+
+type testAction struct {
+	typ ActionType
+}
+
+func (a testAction) Type() ActionType {
+	return a.typ
+}
+
+type orderData struct {
+	Amount int
+}
+
+// emit returns a handler, which fires the event and keeps the data.
+func emit(event Event) ActionHandler {
+	return func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+		return event, data, nil
+	}
+}
+
+// emitActionType is a handler, which fires the type of the action as the event.
+func emitActionType(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+	return Event(a.Type()), data, nil
+}
+
+// newTestFlow creates the flow "1" of the type Order in the initial state.
+func newTestFlow(table TransitionTable, initial State, data FlowData) *Flow {
+	return New(CreateFlowOpts{
+		ID:              "1",
+		Type:            "Order",
+		Data:            data,
+		InitialState:    initial,
+		TransitionTable: table,
+	})
+}
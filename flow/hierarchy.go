@@ -0,0 +1,93 @@
+package flow
+
+import "sort"
+
+// Path returns the path from the outermost ancestor down to the given state.
+// For a state without a parent, the path only contains the state itself.
+func (t TransitionTable) Path(state State) []State {
+	path := []State{state}
+	for s := t[state].Parent; s != "" && len(path) <= len(t); s = t[s].Parent {
+		path = append([]State{s}, path...)
+	}
+	return path
+}
+
+// Children returns the direct children of a state, sorted by name.
+func (t TransitionTable) Children(state State) []State {
+	children := make([]State, 0)
+	for s, config := range t {
+		if config.Parent == state && s != state {
+			children = append(children, s)
+		}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i] < children[j] })
+	return children
+}
+
+// IsCompound reports whether a state contains child states.
+func (t TransitionTable) IsCompound(state State) bool {
+	return t[state].Initial != ""
+}
+
+// InitialLeaf returns the state which is actually entered when the flow transitions to the given state.
+// For a compound state, this is its initial child, resolved recursively.
+// For any other state, it is the state itself.
+func (t TransitionTable) InitialLeaf(state State) State {
+	for i := 0; t[state].Initial != "" && i < len(t); i++ {
+		state = t[state].Initial
+	}
+	return state
+}
+
+// resolveHandler finds the handler for a state, starting from the state itself and going outward.
+// The handler is wrapped with the middlewares of the flow and of the state path.
+// If no state in the path has a handler, the default handler is used.
+func (f *Flow) resolveHandler(state State) ActionHandler {
+	path := f.states.Path(state)
+	for i := len(path) - 1; i >= 0; i-- {
+		if handler := f.states[path[i]].Handler; handler != nil {
+			return f.wrapHandler(handler, path)
+		}
+	}
+	return f.wrapHandler(f.defaultHandler, path)
+}
+
+// activeStateSet returns all active states of the flow, including their ancestors, from the outermost.
+// When the flow is in a parallel state, it contains the active states of every region.
+func (f *Flow) activeStateSet() []State {
+	states := f.states.Path(f.currentState)
+	if !f.inParallelState() {
+		return states
+	}
+	depth := len(states)
+	for _, region := range f.states[f.currentState].Regions {
+		states = append(states, f.states.Path(f.regions[region])[depth:]...)
+	}
+	return states
+}
+
+// transitionScope returns the states, which are exited and entered by a transition from one state to another.
+// The common ancestors of both states stay active, while a transition from a state to itself exits and re-enters it.
+// The exited states are ordered from the innermost, and the entered states from the outermost.
+func (f *Flow) transitionScope(from State, to State) (exited []State, entered []State) {
+	fromPath := f.states.Path(from)
+	toPath := f.states.Path(to)
+	depth := 0
+	for depth < len(fromPath) && depth < len(toPath) && fromPath[depth] == toPath[depth] {
+		depth++
+	}
+	if depth == len(fromPath) || depth == len(toPath) {
+		depth--
+	}
+	active := f.activeStateSet()
+	for i := len(active) - 1; i >= 0; i-- {
+		if f.states.contains(fromPath[depth], active[i]) {
+			exited = append(exited, active[i])
+		}
+	}
+	entered = append(entered, toPath[depth:]...)
+	for _, region := range f.states[to].Regions {
+		entered = append(entered, f.states.Path(f.states.InitialLeaf(region))[len(toPath):]...)
+	}
+	return exited, entered
+}
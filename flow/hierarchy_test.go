@@ -0,0 +1,70 @@
+package flow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func checkoutTable() TransitionTable {
+	return TransitionTable{
+		"Checkout": StateConfig{
+			Initial: "Cart",
+			Transitions: Transitions{
+				"Canceled": "Canceled",
+			},
+		},
+		"Cart": StateConfig{
+			Parent:  "Checkout",
+			Handler: emit("Submitted"),
+			Transitions: Transitions{
+				"Submitted": "Payment",
+			},
+		},
+		"Payment": StateConfig{
+			Parent:  "Checkout",
+			Initial: "EnterCard",
+		},
+		"EnterCard": StateConfig{
+			Parent: "Payment",
+			Transitions: Transitions{
+				"Paid": "Done",
+			},
+		},
+		"Done":     StateConfig{Final: true},
+		"Canceled": StateConfig{Final: true},
+	}
+}
+
+func TestHierarchicalStates(t *testing.T) {
+	t.Run("EnterInitialLeaf", func(t *testing.T) {
+		f := newTestFlow(checkoutTable(), "Checkout", nil).WithDefaultActionHandler(emitActionType)
+		require.Equal(t, State("Cart"), f.CurrentState())
+		require.Equal(t, []State{"Checkout", "Cart"}, f.CurrentStatePath())
+	})
+
+	t.Run("ChildHandlerAndCompoundTarget", func(t *testing.T) {
+		f := newTestFlow(checkoutTable(), "Checkout", nil).WithDefaultActionHandler(emitActionType)
+		require.NoError(t, f.HandleAction(context.Background(), testAction{"Ignored"}))
+		require.Equal(t, State("EnterCard"), f.CurrentState())
+		require.Equal(t, []State{"Checkout", "Payment", "EnterCard"}, f.CurrentStatePath())
+	})
+
+	t.Run("InheritedTransition", func(t *testing.T) {
+		f := newTestFlow(checkoutTable(), "Checkout", nil).WithDefaultActionHandler(emitActionType)
+		require.NoError(t, f.HandleAction(context.Background(), testAction{"Ignored"}))
+		require.NoError(t, f.HandleAction(context.Background(), testAction{"Canceled"}))
+		require.Equal(t, State("Canceled"), f.CurrentState())
+		require.True(t, f.IsCompleted())
+	})
+
+	t.Run("SnapshotRoundTrip", func(t *testing.T) {
+		f := newTestFlow(checkoutTable(), "Checkout", nil).WithDefaultActionHandler(emitActionType)
+		require.NoError(t, f.HandleAction(context.Background(), testAction{"Ignored"}))
+		s, err := f.ToSnapshot()
+		require.NoError(t, err)
+		restored := FromSnapshot(s, checkoutTable())
+		require.Equal(t, f.CurrentStatePath(), restored.CurrentStatePath())
+	})
+}
@@ -0,0 +1,120 @@
+package flow
+
+import "time"
+
+// DefaultMaxHistoryEntries is the default number of entries kept in the history of a flow.
+const DefaultMaxHistoryEntries = 100
+
+// HistoryEntry records a transition of a flow, or a failed attempt of one.
+type HistoryEntry struct {
+	// Timestamp is the time at which the transition happened.
+	Timestamp time.Time `json:"timestamp"`
+	// From is the state in which the flow was, when the action or event was received.
+	From State `json:"from"`
+	// ActionType is the type of the handled action. It is empty for transitions caused by timers or joins.
+	ActionType ActionType `json:"action_type,omitempty"`
+	// Event is the event which caused the transition. It is empty if the handler returned no event.
+	Event Event `json:"event,omitempty"`
+	// To is the state in which the flow ended up. It is empty if the transition failed.
+	To State `json:"to,omitempty"`
+	// Error is the error which aborted the transition, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// HistoryPolicy configures how the history of a flow is recorded and retained.
+type HistoryPolicy struct {
+	// MaxEntries is the maximum number of entries kept. When it is exceeded, the oldest entries are dropped.
+	// Defaults to [DefaultMaxHistoryEntries].
+	MaxEntries int
+	// MaxAge is the maximum age of the entries kept. Older entries are dropped when a new entry is recorded.
+	// If it is zero, entries are only dropped because of MaxEntries.
+	MaxAge time.Duration
+}
+
+// cause describes what triggered a transition. It is recorded in the history.
+type cause struct {
+	action ActionType
+	event  Event
+	from   State
+	// at is the time of the call, which caused the transition, e.g. the time passed to Tick.
+	at time.Time
+}
+
+// History returns the recorded transitions of the flow, from the oldest.
+// It is empty if no history policy is set.
+func (f *Flow) History() []HistoryEntry {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.copyHistory()
+}
+
+func (f *Flow) copyHistory() []HistoryEntry {
+	if len(f.history) == 0 {
+		return nil
+	}
+	return append([]HistoryEntry(nil), f.history...)
+}
+
+// WithHistory enables the history of the flow with the given policy.
+// This is useful for flows restored from a snapshot, see [CreateFlowOpts.History].
+func (f *Flow) WithHistory(policy HistoryPolicy) *Flow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.historyPolicy = &policy
+	return f
+}
+
+// record adds an entry to the history, if it is enabled.
+func (f *Flow) record(c cause, to State, err error) {
+	entry := HistoryEntry{
+		Timestamp:  c.at,
+		From:       c.from,
+		ActionType: c.action,
+		Event:      c.event,
+		To:         to,
+	}
+	if err != nil {
+		entry.To = ""
+		entry.Error = err.Error()
+	}
+	f.appendHistory(entry)
+}
+
+// appendHistory adds an entry to the history. Since the history is part of the snapshot,
+// the entry changes the flow, even if it records a failed action.
+func (f *Flow) appendHistory(entry HistoryEntry) {
+	if f.historyPolicy == nil {
+		return
+	}
+	f.journaling.changed = true
+	f.history = append(f.history, entry)
+	f.history = f.historyPolicy.retain(f.history, entry.Timestamp)
+}
+
+// recordError adds a failed transition to the history, and returns the error.
+func (f *Flow) recordError(c cause, err error) error {
+	f.record(c, "", err)
+	f.journaling.fail(c, err)
+	return err
+}
+
+// retain drops the entries, which are not kept according to the policy.
+func (p *HistoryPolicy) retain(history []HistoryEntry, now time.Time) []HistoryEntry {
+	maxEntries := p.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxHistoryEntries
+	}
+	start := 0
+	if len(history) > maxEntries {
+		start = len(history) - maxEntries
+	}
+	if p.MaxAge > 0 {
+		for start < len(history) && now.Sub(history[start].Timestamp) > p.MaxAge {
+			start++
+		}
+	}
+	if start == 0 {
+		return history
+	}
+	return append([]HistoryEntry(nil), history[start:]...)
+}
@@ -0,0 +1,100 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	table := TransitionTable{
+		"Draft": StateConfig{
+			Handler: func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+				switch a.Type() {
+				case "Submit":
+					return "Submitted", data, nil
+				case "Save":
+					return NoEvent, data, nil
+				}
+				return NoEvent, data, fmt.Errorf("unsupported action: %s", a.Type())
+			},
+			Transitions: Transitions{"Submitted": "Review"},
+		},
+		"Review": StateConfig{
+			Handler:     emit("Approved"),
+			Autopass:    true,
+			Transitions: Transitions{"Approved": "Published"},
+		},
+		"Published": StateConfig{Final: true},
+	}
+	t.Run("Disabled", func(t *testing.T) {
+		f := newTestFlow(table, "Draft", nil)
+		require.NoError(t, f.HandleAction(ctx, testAction{"Submit"}))
+		require.Empty(t, f.History())
+	})
+
+	t.Run("Entries", func(t *testing.T) {
+		f := newTestFlow(table, "Draft", nil).WithHistory(HistoryPolicy{})
+		require.NoError(t, f.HandleAction(ctx, testAction{"Save"}))
+		require.Error(t, f.HandleAction(ctx, testAction{"Delete"}))
+		require.NoError(t, f.HandleAction(ctx, testAction{"Submit"}))
+
+		history := f.History()
+		require.Len(t, history, 4)
+		for i := range history {
+			require.False(t, history[i].Timestamp.IsZero())
+			history[i].Timestamp = time.Time{}
+		}
+		require.Equal(t, []HistoryEntry{
+			{From: "Draft", ActionType: "Save", To: "Draft"},
+			{From: "Draft", ActionType: "Delete", Error: "unsupported action: Delete"},
+			{From: "Draft", ActionType: "Submit", Event: "Submitted", To: "Review"},
+			{From: "Review", ActionType: "Autopass", Event: "Approved", To: "Published"},
+		}, history)
+	})
+
+	t.Run("MaxEntries", func(t *testing.T) {
+		f := newTestFlow(table, "Draft", nil).WithHistory(HistoryPolicy{MaxEntries: 2})
+		for i := 0; i < 5; i++ {
+			require.NoError(t, f.HandleAction(ctx, testAction{"Save"}))
+		}
+		require.NoError(t, f.HandleAction(ctx, testAction{"Submit"}))
+		history := f.History()
+		require.Len(t, history, 2)
+		require.Equal(t, ActionType("Submit"), history[0].ActionType)
+		require.Equal(t, State("Published"), history[1].To)
+	})
+
+	t.Run("MaxAge", func(t *testing.T) {
+		f := newTestFlow(table, "Draft", nil).WithHistory(HistoryPolicy{MaxAge: time.Hour})
+		require.NoError(t, f.HandleAction(ctx, testAction{"Save"}))
+		f.history[0].Timestamp = time.Now().Add(-2 * time.Hour)
+		require.NoError(t, f.HandleAction(ctx, testAction{"Save"}))
+		history := f.History()
+		require.Len(t, history, 1)
+		require.WithinDuration(t, time.Now(), history[0].Timestamp, time.Minute)
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		f := newTestFlow(table, "Draft", nil).WithHistory(HistoryPolicy{})
+		require.NoError(t, f.HandleAction(ctx, testAction{"Save"}))
+		snapshot, err := f.ToSnapshot()
+		require.NoError(t, err)
+		encoded, err := json.Marshal(snapshot)
+		require.NoError(t, err)
+		var decoded Snapshot
+		require.NoError(t, json.Unmarshal(encoded, &decoded))
+
+		restored := FromSnapshot(&decoded, table).WithHistory(HistoryPolicy{})
+		require.NoError(t, restored.HandleAction(ctx, testAction{"Submit"}))
+		history := restored.History()
+		require.Len(t, history, 3)
+		require.Equal(t, ActionType("Save"), history[0].ActionType)
+		require.Equal(t, State("Published"), history[2].To)
+	})
+}
@@ -20,14 +20,6 @@ func composePreTransitionHooks(hooks []hookFn) hookFn {
 	}
 }
 
-func composeSilentHooks(hooks []silentHookFn) silentHookFn {
-	return func(ctx context.Context, data FlowData) {
-		for _, hook := range hooks {
-			hook(ctx, data)
-		}
-	}
-}
-
 func composeHydrationHooks(hooks []hydrationHookFn) hydrationHookFn {
 	return func(ctx context.Context, data FlowData) (FlowData, error) {
 		for _, hook := range hooks {
@@ -54,6 +46,8 @@ type silentHookFn func(ctx context.Context, data FlowData)
 // If the hook returns nil, the transition will continue.
 // If the state does not exist, the hook will not be registered.
 func (f *Flow) RegisterPreTransition(state State, hook hookFn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.hookTable == nil {
 		f.hookTable = make(preTransitionHookTable)
 	}
@@ -64,6 +58,8 @@ func (f *Flow) RegisterPreTransition(state State, hook hookFn) {
 }
 
 func (f *Flow) RegisterPostTransition(state State, hook silentHookFn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.postHookTable == nil {
 		f.postHookTable = make(silentHookTable)
 	}
@@ -74,6 +70,8 @@ func (f *Flow) RegisterPostTransition(state State, hook silentHookFn) {
 }
 
 func (f *Flow) RegisterCompletionHook(state State, hook silentHookFn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.completionHooks == nil {
 		f.completionHooks = make([]silentHookFn, 0)
 	}
@@ -91,24 +89,6 @@ func (f *Flow) composePreTransitionHooks(state State) hookFn {
 	return composePreTransitionHooks(hooks)
 }
 
-func (f *Flow) composePostTransitionHooks(state State) silentHookFn {
-	if f.postHookTable == nil {
-		return nil
-	}
-	hooks := f.postHookTable[state]
-	if len(hooks) == 0 {
-		return nil
-	}
-	return composeSilentHooks(hooks)
-}
-
-func (f *Flow) composeCompletionHooks() silentHookFn {
-	if f.completionHooks == nil {
-		return nil
-	}
-	return composeSilentHooks(f.completionHooks)
-}
-
 // TypedPreHook creates a pre-transition hook for a specific data type.
 func TypedPreHook[D FlowData](hook func(D) error) hookFn {
 	return func(ctx context.Context, data FlowData) error {
@@ -1,5 +1,7 @@
 package flow
 
+import "sync"
+
 var (
 	globalHookRegistry = newHookRegistry()
 )
@@ -10,6 +12,7 @@ type postTransitionRegistry hookRegistryType[silentHookFn]
 type hydrationRegistry map[FlowType][]hydrationHookFn
 type completionRegistry map[FlowType][]silentHookFn
 type hookRegistry struct {
+	mu                  sync.RWMutex
 	hydrationHooks      hydrationRegistry
 	preTransitionHooks  preTransitionRegistry
 	postTransitionHooks postTransitionRegistry
@@ -26,6 +29,8 @@ func newHookRegistry() *hookRegistry {
 }
 
 func (r *hookRegistry) composeHydrationHooks(flowType FlowType) hydrationHookFn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	if _, ok := r.hydrationHooks[flowType]; !ok {
 		return nil
 	}
@@ -33,6 +38,8 @@ func (r *hookRegistry) composeHydrationHooks(flowType FlowType) hydrationHookFn
 }
 
 func (r *hookRegistry) composePreTransitions(flowType FlowType, state State) hookFn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	if _, ok := r.preTransitionHooks[flowType]; !ok {
 		return nil
 	}
@@ -42,24 +49,21 @@ func (r *hookRegistry) composePreTransitions(flowType FlowType, state State) hoo
 	return composePreTransitionHooks(r.preTransitionHooks[flowType][state])
 }
 
-func (r *hookRegistry) composePostTransitionHooks(flowType FlowType, state State) silentHookFn {
-	if _, ok := r.postTransitionHooks[flowType]; !ok {
-		return nil
-	}
-	if _, ok := r.postTransitionHooks[flowType][state]; !ok {
-		return nil
-	}
-	return composeSilentHooks(r.postTransitionHooks[flowType][state])
+func (r *hookRegistry) postTransitionHookList(flowType FlowType, state State) []silentHookFn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.postTransitionHooks[flowType][state]
 }
 
-func (r *hookRegistry) composeCompletionHooks(flowType FlowType) silentHookFn {
-	if _, ok := r.completionHooks[flowType]; !ok {
-		return nil
-	}
-	return composeSilentHooks(r.completionHooks[flowType])
+func (r *hookRegistry) completionHookList(flowType FlowType) []silentHookFn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.completionHooks[flowType]
 }
 
 func (r *hookRegistry) RegisterHydration(flowType FlowType, hook hydrationHookFn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if _, ok := r.hydrationHooks[flowType]; !ok {
 		r.hydrationHooks[flowType] = []hydrationHookFn{}
 	}
@@ -67,14 +71,20 @@ func (r *hookRegistry) RegisterHydration(flowType FlowType, hook hydrationHookFn
 }
 
 func (r *hookRegistry) RegisterPreTransition(flowType FlowType, state State, hook hookFn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.preTransitionHooks = addHookToRegistry[hookFn](r.preTransitionHooks, flowType, state, hook)
 }
 
 func (r *hookRegistry) RegisterPostTransition(flowType FlowType, state State, hook silentHookFn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.postTransitionHooks = addHookToRegistry[silentHookFn](r.postTransitionHooks, flowType, state, hook)
 }
 
 func (r *hookRegistry) RegisterCompletion(flowType FlowType, hook silentHookFn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if _, ok := r.completionHooks[flowType]; !ok {
 		r.completionHooks[flowType] = []silentHookFn{}
 	}
@@ -0,0 +1,84 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type callRecorder struct {
+	calls []string
+}
+
+func (r *callRecorder) hook(name string) hookFn {
+	return func(ctx context.Context, data FlowData) error {
+		r.calls = append(r.calls, name)
+		return nil
+	}
+}
+
+func (r *callRecorder) silentHook(name string) silentHookFn {
+	return func(ctx context.Context, data FlowData) {
+		r.calls = append(r.calls, name)
+	}
+}
+
+// documentFlow creates a flow, which records the calls of its entry and exit actions, and of its hooks.
+func documentFlow(r *callRecorder, onEntryReview hookFn) *Flow {
+	table := TransitionTable{
+		"Editing": StateConfig{
+			Initial: "Draft",
+			OnExit:  r.hook("exit:Editing"),
+		},
+		"Draft": StateConfig{
+			Parent:      "Editing",
+			Handler:     emit("Submitted"),
+			OnExit:      r.hook("exit:Draft"),
+			Transitions: Transitions{"Submitted": "Review"},
+		},
+		"Review": StateConfig{
+			Handler:     emit("Approved"),
+			Autopass:    true,
+			OnEntry:     onEntryReview,
+			OnExit:      r.hook("exit:Review"),
+			Transitions: Transitions{"Approved": "Published"},
+		},
+		"Published": StateConfig{
+			Final:   true,
+			OnEntry: r.hook("entry:Published"),
+		},
+	}
+	f := newTestFlow(table, "Editing", nil)
+	f.RegisterPreTransition("Review", r.hook("pre:Review"))
+	f.RegisterPostTransition("Review", r.silentHook("post:Review"))
+	f.RegisterPreTransition("Published", r.hook("pre:Published"))
+	f.RegisterPostTransition("Published", r.silentHook("post:Published"))
+	return f
+}
+
+func TestEntryAndExitActions(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Order", func(t *testing.T) {
+		r := &callRecorder{}
+		f := documentFlow(r, r.hook("entry:Review"))
+		require.NoError(t, f.HandleAction(ctx, testAction{"Submit"}))
+		require.Equal(t, State("Published"), f.CurrentState())
+		require.Equal(t, []string{
+			"exit:Draft", "exit:Editing", "pre:Review", "entry:Review", "post:Review",
+			"exit:Review", "pre:Published", "entry:Published", "post:Published",
+		}, r.calls)
+	})
+
+	t.Run("AbortOnError", func(t *testing.T) {
+		r := &callRecorder{}
+		f := documentFlow(r, func(ctx context.Context, data FlowData) error {
+			return fmt.Errorf("review not possible")
+		})
+		require.Error(t, f.HandleAction(ctx, testAction{"Submit"}))
+		require.Equal(t, State("Draft"), f.CurrentState())
+		require.Equal(t, []string{"exit:Draft", "exit:Editing", "pre:Review"}, r.calls)
+	})
+}
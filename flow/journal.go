@@ -0,0 +1,426 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/necrobits/x/errors"
+)
+
+// DefaultSnapshotInterval is the default number of journal entries between two snapshots of a flow.
+const DefaultSnapshotInterval = 50
+
+// Journal persists the outcomes of the actions handled by a single flow, so the flow can be rebuilt with [Replay].
+// It also stores the latest snapshot of the flow, so the replay does not have to start from the beginning.
+type Journal interface {
+	// Append appends an entry to the journal. Its sequence number must follow the last appended entry.
+	Append(ctx context.Context, entry JournalEntry) error
+	// Entries returns the entries with a sequence number greater than seq, in order.
+	Entries(ctx context.Context, seq uint64) ([]JournalEntry, error)
+	// SaveSnapshot stores a snapshot of the flow, which replaces the previous one.
+	SaveSnapshot(ctx context.Context, s *Snapshot) error
+	// LatestSnapshot returns the latest stored snapshot of the flow.
+	LatestSnapshot(ctx context.Context) (*Snapshot, error)
+}
+
+// JournalEntry is the recorded outcome of an action, or of a tick firing timers.
+// Actions, which failed without changing the flow or its history, are not recorded.
+//
+// An entry records the action, and the transitions and failures it caused. Since the handlers are not called again
+// by [Replay], the change of the data is recorded as well, as a JSON merge patch (RFC 7386) of the encoded data.
+// Hence, an entry only grows with the part of the data, which the action has changed.
+type JournalEntry struct {
+	// Seq is the sequence number of the entry in the journal, starting at 1.
+	Seq uint64 `json:"seq"`
+	// Timestamp is the time at which the entry was recorded.
+	Timestamp time.Time `json:"timestamp"`
+	// ActionType is the type of the handled action. It is empty for a tick.
+	ActionType ActionType `json:"action_type,omitempty"`
+	// EncodedAction is the marshalled action.
+	EncodedAction json.RawMessage `json:"action,omitempty"`
+	// Fired contains the timers fired by a tick.
+	Fired []Deadline `json:"fired,omitempty"`
+	// Steps contains the transitions of the flow, and the failed attempts of transitions, in the order in which they happened.
+	Steps []JournalStep `json:"steps,omitempty"`
+	// Compensated contains the states compensated by [Flow.Compensate], in the order of their compensation.
+	Compensated []State `json:"compensated,omitempty"`
+	// Compensating indicates whether the flow is still compensating afterwards.
+	Compensating bool `json:"compensating,omitempty"`
+	// Expired indicates whether the flow has followed its expiration transition, see [Flow.Expire].
+	Expired bool `json:"expired,omitempty"`
+	// Child is the snapshot of the running child flow afterwards, if any.
+	Child *Snapshot `json:"child,omitempty"`
+	// Revision is the revision of the flow afterwards.
+	Revision uint64 `json:"revision"`
+	// Version is the version of the definition of the flow, see [Migration].
+	Version int `json:"version,omitempty"`
+	// DataPatch is the JSON merge patch, which turns the marshalled data of the flow before the entry into the data afterwards.
+	// It is empty, if the data has not changed.
+	DataPatch json.RawMessage `json:"data_patch,omitempty"`
+}
+
+// transitioned reports whether the entry contains a transition, which has not failed.
+func (e JournalEntry) transitioned() bool {
+	for _, step := range e.Steps {
+		if step.Error == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// JournalStep is a single recorded transition, or a failed attempt of one.
+type JournalStep struct {
+	// Region is the region of the transition, if it happened inside a region of a parallel state.
+	Region State `json:"region,omitempty"`
+	// From is the state, which received the event.
+	From State `json:"from"`
+	// ActionType is the type of the action, which caused the transition. It is empty for timers and joins.
+	ActionType ActionType `json:"action_type,omitempty"`
+	// Event is the event, which caused the transition.
+	Event Event `json:"event,omitempty"`
+	// To is the next state. It is empty, if the transition has failed.
+	To State `json:"to,omitempty"`
+	// At is the time at which the transition happened.
+	At time.Time `json:"at"`
+	// Error is the error, which aborted the transition, if any. A failed transition does not change the flow,
+	// but it is added to the history of the flow on replay.
+	Error string `json:"error,omitempty"`
+}
+
+// journaling collects the outcome of an action, while the flow is attached to a journal.
+type journaling struct {
+	journal  Journal
+	interval int
+	seq      uint64
+	// data is the marshalled data of the flow at the last entry or snapshot, which the next data patch is based on.
+	data    json.RawMessage
+	steps   []JournalStep
+	fired   []Deadline
+	changed bool
+	// compensated contains the states compensated by the current call of Compensate.
+	compensated []State
+	// expired indicates whether the flow has followed its expiration transition.
+	expired bool
+}
+
+func (j *journaling) reset() {
+	j.steps = nil
+	j.fired = nil
+	j.compensated = nil
+	j.expired = false
+	j.changed = false
+}
+
+func (j *journaling) step(region State, c cause, to State, at time.Time) {
+	if j.journal == nil {
+		return
+	}
+	j.steps = append(j.steps, JournalStep{
+		Region:     region,
+		From:       c.from,
+		ActionType: c.action,
+		Event:      c.event,
+		To:         to,
+		At:         at,
+	})
+}
+
+// fail records a failed transition.
+func (j *journaling) fail(c cause, err error) {
+	if j.journal == nil {
+		return
+	}
+	j.steps = append(j.steps, JournalStep{
+		From:       c.from,
+		ActionType: c.action,
+		Event:      c.event,
+		At:         c.at,
+		Error:      err.Error(),
+	})
+}
+
+func (j *journaling) fire(deadline Deadline) {
+	if j.journal == nil {
+		return
+	}
+	j.fired = append(j.fired, deadline)
+}
+
+func (j *journaling) snapshotInterval() uint64 {
+	if j.interval <= 0 {
+		return DefaultSnapshotInterval
+	}
+	return uint64(j.interval)
+}
+
+// AttachJournal makes the flow append the outcome of every following action and tick to the journal,
+// and save a snapshot to it every snapshotInterval entries. A snapshot of the current state is saved right away,
+// so the flow can be rebuilt from the journal with [Replay].
+//
+// If appending to the journal fails, the action has already changed the flow, but the journal has not,
+// so the flow should be rebuilt from the journal before handling further actions.
+func (f *Flow) AttachJournal(ctx context.Context, journal Journal, snapshotInterval int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.journaling.journal = journal
+	f.journaling.interval = snapshotInterval
+	return f.saveJournalSnapshot(ctx)
+}
+
+// appendJournal appends the collected outcome of an action or a tick to the journal.
+// The error of the action is returned, unless the journal fails.
+func (f *Flow) appendJournal(ctx context.Context, a Action, err error) error {
+	j := &f.journaling
+	if j.journal == nil || (!j.changed && len(j.fired) == 0) {
+		return err
+	}
+	entry := JournalEntry{
+		Seq:          j.seq + 1,
+		Timestamp:    time.Now(),
+		Revision:     f.revision,
+		Version:      f.version,
+		Fired:        j.fired,
+		Steps:        j.steps,
+		Compensated:  j.compensated,
+		Compensating: f.compensating,
+		Expired:      j.expired,
+	}
+	if a != nil {
+		entry.ActionType = a.Type()
+		var encodeErr error
+		if entry.EncodedAction, encodeErr = json.Marshal(a); encodeErr != nil {
+			return encodeErr
+		}
+	}
+	encodedData, encodeErr := json.Marshal(f.data)
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if entry.DataPatch, encodeErr = createMergePatch(j.data, encodedData); encodeErr != nil {
+		return encodeErr
+	}
+	if f.child != nil {
+		if entry.Child, encodeErr = f.child.ToSnapshot(); encodeErr != nil {
+			return encodeErr
+		}
+	}
+	if appendErr := j.journal.Append(ctx, entry); appendErr != nil {
+		return appendErr
+	}
+	j.seq = entry.Seq
+	j.data = encodedData
+	if j.seq%j.snapshotInterval() == 0 {
+		if snapshotErr := f.saveJournalSnapshot(ctx); snapshotErr != nil {
+			return snapshotErr
+		}
+	}
+	return err
+}
+
+func (f *Flow) saveJournalSnapshot(ctx context.Context) error {
+	f.logf("Saving snapshot at journal entry: %d\n", f.journaling.seq)
+	snapshot, err := f.toSnapshot()
+	if err != nil {
+		return err
+	}
+	if err := f.journaling.journal.SaveSnapshot(ctx, snapshot); err != nil {
+		return err
+	}
+	f.journaling.data = snapshot.EncodedData
+	return nil
+}
+
+// Replay rebuilds a flow from a journal. It restores the latest snapshot of the journal using the definition,
+// and applies the entries appended after it. The recorded transitions and data patches are applied as they are:
+// neither handlers, nor guards, nor hooks are called, so the flow ends up exactly as it was recorded.
+// The recorded failures are added to the history of the flow, if it has a history policy.
+// The snapshot and the entries of previous versions of the definition are migrated, see [Definition.Migrate].
+// Afterwards, the hydration hooks are called, and the flow is attached to the journal.
+func Replay(ctx context.Context, def *Definition, journal Journal) (*Flow, error) {
+	snapshot, err := journal.LatestSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data := &replayedData{encoded: snapshot.EncodedData, version: snapshot.Version}
+	if err := def.Migrate(snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Data, err = def.decodeData(snapshot.EncodedData); err != nil {
+		return nil, err
+	}
+	f := def.restore(snapshot)
+	if err := f.replayChild(snapshot.Child); err != nil {
+		return nil, err
+	}
+	entries, err := journal.Entries(ctx, snapshot.JournalSeq)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if err := f.replay(def, entry, data); err != nil {
+			return nil, err
+		}
+	}
+	if data.changed {
+		encoded, err := def.migrateData(data.encoded, data.version, def.Version)
+		if err != nil {
+			return nil, err
+		}
+		if f.data, err = def.decodeData(encoded); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.hydrate(ctx); err != nil {
+		return nil, err
+	}
+	if f.journaling.data, err = json.Marshal(f.data); err != nil {
+		return nil, err
+	}
+	f.journaling.journal = journal
+	f.journaling.interval = def.SnapshotInterval
+	return f, nil
+}
+
+// replayedData is the marshalled data of a replayed flow. The data patches of the entries are applied to it
+// in the version of the entries, and it is migrated to the version of the definition afterwards.
+type replayedData struct {
+	encoded json.RawMessage
+	version int
+	changed bool
+}
+
+func (r *replayedData) apply(def *Definition, entry JournalEntry) error {
+	encoded, err := def.migrateData(r.encoded, r.version, entry.Version)
+	if err != nil {
+		return err
+	}
+	if r.encoded, err = applyMergePatch(encoded, entry.DataPatch); err != nil {
+		return err
+	}
+	r.version = entry.Version
+	r.changed = true
+	return nil
+}
+
+// replay applies a recorded entry to the flow, and its data patch to the replayed data.
+func (f *Flow) replay(def *Definition, entry JournalEntry, data *replayedData) error {
+	if entry.Seq != f.journaling.seq+1 {
+		return errors.B().
+			Code(ErrInvalidJournal).
+			Op("flow.Replay").
+			Msgf("expected journal entry %d, got %d", f.journaling.seq+1, entry.Seq).Build()
+	}
+	if len(entry.DataPatch) > 0 {
+		if err := data.apply(def, entry); err != nil {
+			return err
+		}
+	}
+	if err := def.migrateEntry(&entry); err != nil {
+		return err
+	}
+	for _, deadline := range entry.Fired {
+		f.removeDeadline(deadline)
+	}
+	if entry.ActionType == (compensationAction{}).Type() {
+		f.compensating = true
+		if err := f.replayCompensations(entry.Compensated); err != nil {
+			return err
+		}
+		if entry.transitioned() {
+			f.completed = false
+		}
+	}
+	if entry.Expired {
+		f.expiresAt = time.Time{}
+	}
+	for _, step := range entry.Steps {
+		if err := f.replayStep(step); err != nil {
+			return err
+		}
+	}
+	f.compensating = entry.Compensating
+	if err := f.replayChild(entry.Child); err != nil {
+		return err
+	}
+	f.revision = entry.Revision
+	f.journaling.seq = entry.Seq
+	return nil
+}
+
+// replayStep applies a recorded transition to the flow, without calling any handler or hook.
+// A failed transition is only added to the history.
+func (f *Flow) replayStep(step JournalStep) error {
+	if step.Error != "" {
+		f.appendHistory(HistoryEntry{
+			Timestamp:  step.At,
+			From:       step.From,
+			ActionType: step.ActionType,
+			Event:      step.Event,
+			Error:      step.Error,
+		})
+		return nil
+	}
+	if _, ok := f.states[step.To]; !ok {
+		return errors.B().
+			Code(ErrInvalidJournal).
+			Op("flow.Replay").
+			Msgf("journal refers to unknown state: %s", step.To).Build()
+	}
+	if step.Region != "" {
+		if _, ok := f.regions[step.Region]; !ok {
+			return errors.B().
+				Code(ErrInvalidJournal).
+				Op("flow.Replay").
+				Msgf("journal refers to inactive region: %s", step.Region).Build()
+		}
+		exited, entered := f.transitionScope(step.From, step.To)
+		f.regions[step.Region] = step.To
+		f.updateDeadlines(exited, entered, step.At)
+		f.recordCompensations(exited)
+	} else {
+		exited, entered := f.transitionScope(f.currentState, step.To)
+		f.enterState(step.To, step.At)
+		f.updateDeadlines(exited, entered, step.At)
+		f.recordCompensations(exited)
+		if f.states[step.To].Final {
+			f.completed = true
+			f.deadlines = nil
+		}
+	}
+	f.appendHistory(HistoryEntry{
+		Timestamp:  step.At,
+		From:       step.From,
+		ActionType: step.ActionType,
+		Event:      step.Event,
+		To:         step.To,
+	})
+	return nil
+}
+
+// replayChild restores the recorded child flow, after the recorded transitions have been applied.
+func (f *Flow) replayChild(s *Snapshot) error {
+	if s == nil {
+		f.restoreChild(nil)
+		return nil
+	}
+	_, invoke := f.invokingState()
+	if invoke == nil {
+		return errors.B().
+			Code(ErrInvalidJournal).
+			Op("flow.Replay").
+			Msgf("journal contains a child flow, but state %s does not invoke one", f.currentState).Build()
+	}
+	child := *s
+	if err := invoke.Definition.Migrate(&child); err != nil {
+		return err
+	}
+	data, err := invoke.Definition.decodeData(child.EncodedData)
+	if err != nil {
+		return err
+	}
+	child.Data = data
+	f.restoreChild(&child)
+	return f.child.replayChild(s.Child)
+}
@@ -0,0 +1,83 @@
+package flow
+
+import (
+	"context"
+	"time"
+)
+
+// Middleware wraps an ActionHandler to add cross-cutting behavior, e.g. logging, timing or authorization checks.
+// A middleware can inspect the action before calling the next handler, skip it by returning an error,
+// and inspect the outcome afterwards. For example:
+//
+//	func RequireUser(next flow.ActionHandler) flow.ActionHandler {
+//		return func(ctx context.Context, data flow.FlowData, a flow.Action) (flow.Event, flow.FlowData, error) {
+//			if UserFrom(ctx) == nil {
+//				return flow.NoEvent, data, ErrUnauthorized
+//			}
+//			return next(ctx, data, a)
+//		}
+//	}
+//
+// Middlewares are attached to a flow with [CreateFlowOpts.Middlewares], to a state with [StateConfig.Middlewares],
+// and to a router with Use. The middlewares of the flow are the outermost, followed by the middlewares of the
+// active states from the outermost ancestor to the state itself, and the middlewares of a router are the innermost.
+type Middleware func(next ActionHandler) ActionHandler
+
+// Chain composes middlewares into a single one. The first middleware is the outermost.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next ActionHandler) ActionHandler {
+		return applyMiddlewares(next, middlewares)
+	}
+}
+
+func applyMiddlewares(handler ActionHandler, middlewares []Middleware) ActionHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Recovery returns a middleware, which turns a panic of the handler into an error with the code [ErrPanic].
+// The flow remains in its state, as if the handler had returned the error.
+// A flow recovers the panics of its handlers anyway, but Recovery lets the outer middlewares, e.g. Timing, see the error.
+func Recovery() Middleware {
+	return recoverHandler
+}
+
+// Timing returns a middleware, which measures the duration of the handler, and reports it with the outcome.
+// For example, to export the durations as a metric:
+//
+//	flow.Timing(func(ctx context.Context, a flow.Action, d time.Duration, err error) {
+//		handlerDuration.WithLabelValues(string(a.Type())).Observe(d.Seconds())
+//	})
+func Timing(observe func(ctx context.Context, a Action, d time.Duration, err error)) Middleware {
+	return func(next ActionHandler) ActionHandler {
+		return func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+			start := time.Now()
+			event, nextData, err := next(ctx, data, a)
+			observe(ctx, a, time.Since(start), err)
+			return event, nextData, err
+		}
+	}
+}
+
+// WithMiddlewares sets the middlewares of the flow, which wrap the handler of every action.
+// This is useful for flows restored from a snapshot, see [CreateFlowOpts.Middlewares].
+func (f *Flow) WithMiddlewares(middlewares ...Middleware) *Flow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.middlewares = middlewares
+	return f
+}
+
+// wrapHandler wraps the handler resolved for the states of a path with their middlewares, and the middlewares of the flow.
+// A panic of the handler or of a middleware is always recovered.
+func (f *Flow) wrapHandler(handler ActionHandler, path []State) ActionHandler {
+	if handler == nil {
+		return nil
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		handler = applyMiddlewares(handler, f.states[path[i]].Middlewares)
+	}
+	return recoverHandler(applyMiddlewares(handler, f.middlewares))
+}
@@ -0,0 +1,95 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/necrobits/x/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func tracing(name string, trace *[]string) Middleware {
+	return func(next ActionHandler) ActionHandler {
+		return func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+			*trace = append(*trace, name)
+			return next(ctx, data, a)
+		}
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	ctx := context.Background()
+	checkoutTable := func(trace *[]string, handler ActionHandler) TransitionTable {
+		router := NewRouter(ActionRoutes{"Pay": handler}).Use(tracing("router", trace))
+		return TransitionTable{
+			"Checkout": StateConfig{
+				Initial:     "Payment",
+				Middlewares: []Middleware{tracing("checkout", trace)},
+			},
+			"Payment": StateConfig{
+				Parent:      "Checkout",
+				Handler:     router.ToHandler(),
+				Middlewares: []Middleware{tracing("payment", trace)},
+				Transitions: Transitions{"Paid": "Done"},
+			},
+			"Done": StateConfig{Final: true},
+		}
+	}
+
+	t.Run("Order", func(t *testing.T) {
+		var trace []string
+		f := New(CreateFlowOpts{
+			InitialState:    "Checkout",
+			TransitionTable: checkoutTable(&trace, emit("Paid")),
+			Middlewares:     []Middleware{Chain(tracing("flow", &trace), tracing("flow2", &trace))},
+		})
+		require.NoError(t, f.HandleAction(ctx, testAction{"Pay"}))
+		require.Equal(t, []string{"flow", "flow2", "checkout", "payment", "router"}, trace)
+		require.Equal(t, State("Done"), f.CurrentState())
+	})
+
+	t.Run("Authorization", func(t *testing.T) {
+		var trace []string
+		deny := func(next ActionHandler) ActionHandler {
+			return func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+				return NoEvent, data, fmt.Errorf("forbidden")
+			}
+		}
+		def := &Definition{
+			InitialState:    "Checkout",
+			TransitionTable: checkoutTable(&trace, emit("Paid")),
+			Middlewares:     []Middleware{deny},
+		}
+		snapshot, err := def.New("1", nil).ToSnapshot()
+		require.NoError(t, err)
+		f, err := def.Restore(snapshot)
+		require.NoError(t, err)
+		require.EqualError(t, f.HandleAction(ctx, testAction{"Pay"}), "forbidden")
+		require.Empty(t, trace)
+		require.Equal(t, State("Payment"), f.CurrentState())
+	})
+
+	t.Run("RecoveryAndTiming", func(t *testing.T) {
+		var trace []string
+		var observed []error
+		timing := Timing(func(ctx context.Context, a Action, d time.Duration, err error) {
+			require.Equal(t, ActionType("Pay"), a.Type())
+			observed = append(observed, err)
+		})
+		panicking := func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+			panic("payment provider unavailable")
+		}
+		f := New(CreateFlowOpts{
+			InitialState:    "Checkout",
+			TransitionTable: checkoutTable(&trace, panicking),
+			Middlewares:     []Middleware{timing, Recovery()},
+		})
+		err := f.HandleAction(ctx, testAction{"Pay"})
+		require.True(t, errors.Is(err, ErrPanic))
+		require.Len(t, observed, 1)
+		require.True(t, errors.Is(observed[0], ErrPanic))
+		require.Equal(t, State("Payment"), f.CurrentState())
+	})
+}
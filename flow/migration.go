@@ -0,0 +1,213 @@
+package flow
+
+import (
+	"encoding/json"
+
+	"github.com/necrobits/x/errors"
+)
+
+// Migration migrates the snapshots of a flow from one version of its definition to another.
+// For example, to split the state Processing of version 1 into Packing and Shipping:
+//
+//	flow.Migration{
+//		From:   1,
+//		To:     2,
+//		States: map[flow.State]flow.State{Processing: Packing},
+//		Snapshot: func(s *flow.Snapshot) error {
+//			if s.CurrentState == Packing && isPacked(s.EncodedData) {
+//				s.CurrentState = Shipping
+//			}
+//			return nil
+//		},
+//	}
+//
+// Migrations are applied to the encoded snapshots, before their data is decoded.
+type Migration struct {
+	// From is the version of the snapshots, which are migrated.
+	From int
+	// To is the version of the migrated snapshots.
+	To int
+	// States maps the states of version From to the states of version To. States not in the map are kept.
+	States map[State]State
+	// Data migrates the marshalled data of the flow to the shape of version To. If it is nil, the data is kept.
+	Data func(data json.RawMessage) (json.RawMessage, error)
+	// Snapshot migrates anything else in the snapshot, e.g. it decides between the parts of a split state.
+	// It is called after the states and the data have been migrated. It is optional,
+	// and it is not applied to the entries of a Journal, which only contain states and data patches.
+	Snapshot func(s *Snapshot) error
+}
+
+// Migrate migrates a snapshot, whose data is not decoded yet, to the version of the definition.
+// The migrations are chained along the shortest path from the version of the snapshot.
+// If there is no such path, or the migrated snapshot is in a state which does not exist in the definition,
+// an error with the code [ErrNoMigrationPath] is returned. A snapshot of the child flow is migrated by its own definition.
+// [Definition.Restore], [Replay] and the flowrepo package migrate the snapshots automatically.
+func (d *Definition) Migrate(s *Snapshot) error {
+	_, child, err := d.migrate(s)
+	if err != nil || child == nil {
+		return err
+	}
+	return child.Migrate(s.Child)
+}
+
+// migrateDecoded migrates a snapshot like Migrate, but its data is already decoded.
+// The data, and the data of the child flow, is decoded again, if it has been changed by a migration.
+func (d *Definition) migrateDecoded(s *Snapshot) error {
+	dataMigrated, child, err := d.migrate(s)
+	if err != nil {
+		return err
+	}
+	if dataMigrated {
+		if s.Data, err = d.decodeData(s.EncodedData); err != nil {
+			return err
+		}
+	}
+	if child == nil {
+		return nil
+	}
+	return child.migrateDecoded(s.Child)
+}
+
+// migrate migrates a snapshot without its child flow. It reports whether the encoded data has been migrated,
+// and returns the definition of the child flow, if the snapshot contains one.
+func (d *Definition) migrate(s *Snapshot) (bool, *Definition, error) {
+	dataMigrated := false
+	if s.Version != d.Version {
+		path, err := d.migrationPath(s.Version, d.Version)
+		if err != nil {
+			return false, nil, err
+		}
+		for _, m := range path {
+			if err := m.apply(s); err != nil {
+				return false, nil, err
+			}
+			dataMigrated = dataMigrated || m.Data != nil
+		}
+	}
+	if _, ok := d.TransitionTable[s.CurrentState]; !ok {
+		return false, nil, errors.B().
+			Code(ErrNoMigrationPath).
+			Op("flow.Migrate").
+			Msgf("state %s of flow %s does not exist in version %d", s.CurrentState, s.ID, d.Version).Build()
+	}
+	if s.Child == nil {
+		return dataMigrated, nil, nil
+	}
+	_, invoke := d.TransitionTable.invoker(s.CurrentState)
+	if invoke == nil {
+		return false, nil, errors.B().
+			Code(ErrNoMigrationPath).
+			Op("flow.Migrate").
+			Msgf("state %s of flow %s does not invoke a child flow in version %d", s.CurrentState, s.ID, d.Version).Build()
+	}
+	return dataMigrated, invoke.Definition, nil
+}
+
+// migrationPath finds the shortest chain of migrations between two versions of the definition.
+func (d *Definition) migrationPath(from int, to int) ([]Migration, error) {
+	paths := map[int][]Migration{from: nil}
+	queue := []int{from}
+	for len(queue) > 0 {
+		version := queue[0]
+		queue = queue[1:]
+		if version == to {
+			return paths[version], nil
+		}
+		for _, m := range d.Migrations {
+			if _, seen := paths[m.To]; m.From != version || seen {
+				continue
+			}
+			paths[m.To] = append(append([]Migration(nil), paths[version]...), m)
+			queue = append(queue, m.To)
+		}
+	}
+	return nil, errors.B().
+		Code(ErrNoMigrationPath).
+		Op("flow.Migrate").
+		Msgf("no migration path from version %d to %d of flow type %s", from, to, d.Type).Build()
+}
+
+func (m Migration) apply(s *Snapshot) error {
+	s.CurrentState = m.state(s.CurrentState)
+	if len(s.Regions) > 0 {
+		regions := make(map[State]State, len(s.Regions))
+		for region, state := range s.Regions {
+			regions[m.state(region)] = m.state(state)
+		}
+		s.Regions = regions
+	}
+	for i := range s.Deadlines {
+		s.Deadlines[i].State = m.state(s.Deadlines[i].State)
+	}
+	for i := range s.Compensations {
+		s.Compensations[i] = m.state(s.Compensations[i])
+	}
+	if m.Data != nil {
+		data, err := m.Data(s.EncodedData)
+		if err != nil {
+			return err
+		}
+		s.EncodedData = data
+	}
+	if m.Snapshot != nil {
+		if err := m.Snapshot(s); err != nil {
+			return err
+		}
+	}
+	s.Version = m.To
+	return nil
+}
+
+func (m Migration) state(state State) State {
+	if migrated, ok := m.States[state]; ok {
+		return migrated
+	}
+	return state
+}
+
+// migrateEntry migrates the states of a journal entry to the version of the definition, like Migrate migrates a snapshot.
+// Its data patch is applied in the version of the entry, and its child flow is migrated, when it is replayed.
+func (d *Definition) migrateEntry(entry *JournalEntry) error {
+	if entry.Version == d.Version {
+		return nil
+	}
+	path, err := d.migrationPath(entry.Version, d.Version)
+	if err != nil {
+		return err
+	}
+	for _, m := range path {
+		for i := range entry.Steps {
+			entry.Steps[i].Region = m.state(entry.Steps[i].Region)
+			entry.Steps[i].From = m.state(entry.Steps[i].From)
+			entry.Steps[i].To = m.state(entry.Steps[i].To)
+		}
+		for i := range entry.Fired {
+			entry.Fired[i].State = m.state(entry.Fired[i].State)
+		}
+		for i := range entry.Compensated {
+			entry.Compensated[i] = m.state(entry.Compensated[i])
+		}
+	}
+	entry.Version = d.Version
+	return nil
+}
+
+// migrateData migrates marshalled data from one version of the definition to another.
+func (d *Definition) migrateData(data json.RawMessage, from int, to int) (json.RawMessage, error) {
+	if from == to {
+		return data, nil
+	}
+	path, err := d.migrationPath(from, to)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range path {
+		if m.Data == nil {
+			continue
+		}
+		if data, err = m.Data(data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
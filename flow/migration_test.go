@@ -0,0 +1,108 @@
+package flow
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/necrobits/x/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type shipmentData struct {
+	Total  int
+	Packed bool
+}
+
+func shipmentDefinition() *Definition {
+	return &Definition{
+		Type:         "Shipment",
+		InitialState: "Created",
+		Version:      3,
+		TransitionTable: TransitionTable{
+			"Created":   StateConfig{Handler: emit("Next"), Transitions: Transitions{"Next": "Packing"}},
+			"Packing":   StateConfig{Handler: emit("Next"), Transitions: Transitions{"Next": "Shipping"}},
+			"Shipping":  StateConfig{Handler: emit("Next"), Transitions: Transitions{"Next": "Completed"}},
+			"Completed": StateConfig{Final: true},
+		},
+		Migrations: []Migration{
+			{
+				// Version 2 split Processing into Packing and Shipping, and renamed Amount to Total.
+				From:   1,
+				To:     2,
+				States: map[State]State{"Processing": "Packing"},
+				Data: func(data json.RawMessage) (json.RawMessage, error) {
+					return bytes.Replace(data, []byte(`"Amount"`), []byte(`"Total"`), 1), nil
+				},
+				Snapshot: func(s *Snapshot) error {
+					if s.CurrentState == "Packing" && bytes.Contains(s.EncodedData, []byte(`"Packed":true`)) {
+						s.CurrentState = "Shipping"
+					}
+					return nil
+				},
+			},
+			{
+				From:   2,
+				To:     3,
+				States: map[State]State{"Done": "Completed"},
+			},
+		},
+		DecodeData: func(data json.RawMessage) (FlowData, error) {
+			shipment := &shipmentData{}
+			return shipment, json.Unmarshal(data, shipment)
+		},
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	def := shipmentDefinition()
+	snapshotOf := func(version int, state State, data string) *Snapshot {
+		return &Snapshot{ID: "1", Type: "Shipment", Version: version, CurrentState: state, EncodedData: json.RawMessage(data)}
+	}
+
+	t.Run("Path", func(t *testing.T) {
+		s := snapshotOf(1, "Processing", `{"Amount":5,"Packed":true}`)
+		require.NoError(t, def.Migrate(s))
+		require.Equal(t, 3, s.Version)
+		require.Equal(t, State("Shipping"), s.CurrentState)
+
+		s.Data, _ = def.DecodeData(s.EncodedData)
+		f, err := def.Hydrate(ctx, s)
+		require.NoError(t, err)
+		require.Equal(t, &shipmentData{Total: 5, Packed: true}, f.Data())
+		require.NoError(t, f.HandleAction(ctx, testAction{"Ship"}))
+		require.Equal(t, State("Completed"), f.CurrentState())
+
+		snapshot, err := f.ToSnapshot()
+		require.NoError(t, err)
+		require.Equal(t, 3, snapshot.Version)
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		s := snapshotOf(2, "Done", `{"Total":5}`)
+		require.NoError(t, def.Migrate(s))
+		require.Equal(t, State("Completed"), s.CurrentState)
+		require.JSONEq(t, `{"Total":5}`, string(s.EncodedData))
+	})
+
+	t.Run("NoPath", func(t *testing.T) {
+		err := def.Migrate(snapshotOf(0, "Processing", `{}`))
+		require.True(t, errors.Is(err, ErrNoMigrationPath))
+		err = def.Migrate(snapshotOf(2, "Unknown", `{}`))
+		require.True(t, errors.Is(err, ErrNoMigrationPath))
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		s := snapshotOf(1, "Processing", `{"Amount":5,"Packed":true}`)
+		s.Data = &shipmentData{}
+		f, err := def.Restore(s)
+		require.NoError(t, err)
+		require.Equal(t, State("Shipping"), f.CurrentState())
+		require.Equal(t, &shipmentData{Total: 5, Packed: true}, f.Data())
+
+		_, err = def.Hydrate(ctx, snapshotOf(0, "Processing", `{}`))
+		require.True(t, errors.Is(err, ErrNoMigrationPath))
+	})
+}
@@ -0,0 +1,206 @@
+package flow
+
+import (
+	"context"
+	"time"
+
+	"github.com/necrobits/x/errors"
+)
+
+// IsParallel reports whether a state is a parallel state, which contains regions.
+func (t TransitionTable) IsParallel(state State) bool {
+	return len(t[state].Regions) > 0
+}
+
+// contains reports whether a state is the given ancestor itself, or one of its descendants.
+func (t TransitionTable) contains(ancestor State, state State) bool {
+	for _, s := range t.Path(state) {
+		if s == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// enterState sets the current state of the flow, which is entered at the given time.
+// If the state is a parallel state, every region enters its initial state.
+func (f *Flow) enterState(state State, at time.Time) {
+	f.currentState = state
+	f.enteredAt = at
+	f.regions = nil
+	if !f.states.IsParallel(state) {
+		return
+	}
+	f.regions = make(map[State]State)
+	for _, region := range f.states[state].Regions {
+		f.regions[region] = f.states.InitialLeaf(region)
+	}
+}
+
+func (f *Flow) inParallelState() bool {
+	return len(f.regions) > 0
+}
+
+func (f *Flow) copyRegions() map[State]State {
+	if !f.inParallelState() {
+		return nil
+	}
+	regions := make(map[State]State, len(f.regions))
+	for region, state := range f.regions {
+		regions[region] = state
+	}
+	return regions
+}
+
+// resolveRegionHandler finds the handler for the active state of a region.
+// Unlike resolveHandler, it does not look beyond the region, so a region without a handler ignores the action.
+func (f *Flow) resolveRegionHandler(region State, state State) ActionHandler {
+	path := f.states.Path(state)
+	for i := len(path) - 1; i >= 0; i-- {
+		if handler := f.states[path[i]].Handler; handler != nil {
+			return f.wrapHandler(handler, path)
+		}
+		if path[i] == region {
+			break
+		}
+	}
+	return nil
+}
+
+// handleRegionAction routes an action to every active region of the current parallel state.
+// A region ignores the action if it has no handler, or if its router has no route for the action.
+// The data returned by the handler of a region is passed to the handler of the next region.
+// If any handler or hook fails, none of the regions changes its state.
+// It reports whether any region has handled the action. If not, the action is handled by the parallel state itself.
+// It also reports whether an automatic transition is pending afterwards.
+func (f *Flow) handleRegionAction(ctx context.Context, a Action, now time.Time) (bool, bool, error) {
+	parallelState := f.currentState
+	_, isAutopass := a.(autopassAction)
+	data := f.data
+	transitions := make([]regionTransition, 0)
+	handled := false
+	for _, region := range f.states[parallelState].Regions {
+		state := f.regions[region]
+		if isAutopass && !f.states[state].Autopass {
+			continue
+		}
+		handler := f.resolveRegionHandler(region, state)
+		if handler == nil {
+			continue
+		}
+		f.logf("Incoming action: %s in region: %s\n", a.Type(), region)
+		inputEvent, nextData, err := handler(ctx, data, a)
+		if errors.Is(err, ErrNoRoute) {
+			continue
+		}
+		handled = true
+		c := cause{action: a.Type(), event: inputEvent, from: state, at: now}
+		if err != nil {
+			f.logf("Error: %v\n", err)
+			return true, false, f.recordError(c, err)
+		}
+		data = nextData
+		if inputEvent == NoEvent {
+			f.logf("<Action>%s -> No event\n", a.Type())
+			continue
+		}
+		nextState, err := f.resolveTransition(ctx, state, inputEvent, data)
+		if err != nil {
+			f.logf("Error: %v\n", err)
+			return true, false, f.recordError(c, err)
+		}
+		f.logf("<Action>%s -> <Event>%s\n", a.Type(), inputEvent)
+		inRegion, err := f.checkRegionTransition(region, state, nextState)
+		if err != nil {
+			return true, false, f.recordError(c, err)
+		}
+		if !inRegion {
+			// The transition leaves the parallel state, so the remaining regions are not visited.
+			pending, err := f.transition(ctx, c, data, nextState)
+			return true, pending, err
+		}
+		if err := f.runTransitionHooks(ctx, data, state, nextState); err != nil {
+			return true, false, f.recordError(c, err)
+		}
+		transitions = append(transitions, regionTransition{region: region, cause: c, to: nextState})
+	}
+	if !handled {
+		return false, false, nil
+	}
+	return true, f.commitRegionTransitions(ctx, data, transitions), nil
+}
+
+// regionTransition is a transition inside a region of a parallel state.
+type regionTransition struct {
+	region State
+	cause  cause
+	to     State
+}
+
+// checkRegionTransition reports whether a transition from the active state of a region stays inside the region.
+// A transition into another region of the same parallel state is not allowed.
+func (f *Flow) checkRegionTransition(region State, from State, to State) (bool, error) {
+	if f.states.contains(region, to) {
+		return true, nil
+	}
+	if f.states.contains(f.currentState, to) {
+		return false, errors.B().
+			Code(ErrRegionCrossing).
+			Op("flow.HandleAction").
+			Msgf("transition from %s to %s crosses the regions of parallel state: %s", from, to, f.currentState).Build()
+	}
+	return false, nil
+}
+
+// commitRegionTransitions applies the transitions inside the regions, after their pre-transition hooks have passed.
+// It reports whether an automatic transition is pending afterwards.
+func (f *Flow) commitRegionTransitions(ctx context.Context, data FlowData, transitions []regionTransition) bool {
+	f.setData(data)
+	for _, t := range transitions {
+		f.logf("Transition: %s -> %s\n", t.cause.from, t.to)
+		exited, entered := f.transitionScope(t.cause.from, t.to)
+		f.regions[t.region] = t.to
+		f.updateDeadlines(exited, entered, t.cause.at)
+		f.recordCompensations(exited)
+		f.record(t.cause, t.to, nil)
+		f.journaling.step(t.region, t.cause, t.to, t.cause.at)
+	}
+	for _, t := range transitions {
+		f.runPostTransitionHooks(ctx, data, t.to)
+	}
+	return f.hasPendingRegions()
+}
+
+// hasPendingRegions reports whether a region has reached an autopass state,
+// or all regions are done and the parallel state has a DoneEvent.
+func (f *Flow) hasPendingRegions() bool {
+	for _, region := range f.states[f.currentState].Regions {
+		if f.states[f.regions[region]].Autopass {
+			f.logf("Reached an autopass state: %s\n", f.regions[region])
+			return true
+		}
+	}
+	return f.regionsDone() && f.states[f.currentState].DoneEvent != NoEvent
+}
+
+// regionsDone reports whether all regions of the current parallel state have reached a final state.
+func (f *Flow) regionsDone() bool {
+	for _, region := range f.states[f.currentState].Regions {
+		if !f.states[f.regions[region]].Final {
+			return false
+		}
+	}
+	return true
+}
+
+// joinRegions raises the DoneEvent of the current parallel state, after all regions are done.
+func (f *Flow) joinRegions(ctx context.Context, now time.Time) (bool, error) {
+	f.logf("All regions are done in state: %s\n", f.currentState)
+	c := cause{event: f.states[f.currentState].DoneEvent, from: f.currentState, at: now}
+	nextState, err := f.resolveTransition(ctx, f.currentState, c.event, f.data)
+	if err != nil {
+		f.logf("Error: %v\n", err)
+		return false, f.recordError(c, err)
+	}
+	return f.transition(ctx, c, f.data, nextState)
+}
@@ -0,0 +1,112 @@
+package flow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fulfillmentData struct {
+	Paid    bool
+	Shipped bool
+}
+
+func fulfillmentTable() TransitionTable {
+	return TransitionTable{
+		"Fulfillment": StateConfig{
+			Regions:   []State{"Payment", "Shipping"},
+			DoneEvent: "Fulfilled",
+			Handler:   emit("Canceled"),
+			Transitions: Transitions{
+				"Fulfilled": "Done",
+				"Canceled":  "Canceled",
+			},
+		},
+		"Payment": StateConfig{
+			Parent:  "Fulfillment",
+			Initial: "AwaitingPayment",
+		},
+		"AwaitingPayment": StateConfig{
+			Parent: "Payment",
+			Handler: NewRouter(ActionRoutes{
+				"Pay": TypedHandler(func(ctx context.Context, d *fulfillmentData, a testAction) (Event, *fulfillmentData, error) {
+					d.Paid = true
+					return "Paid", d, nil
+				}),
+			}).ToHandler(),
+			Transitions: Transitions{
+				"Paid": "Paid",
+			},
+		},
+		"Paid": StateConfig{Parent: "Payment", Final: true},
+		"Shipping": StateConfig{
+			Parent:  "Fulfillment",
+			Initial: "AwaitingShipment",
+		},
+		"AwaitingShipment": StateConfig{
+			Parent: "Shipping",
+			Handler: NewRouter(ActionRoutes{
+				"Ship": TypedHandler(func(ctx context.Context, d *fulfillmentData, a testAction) (Event, *fulfillmentData, error) {
+					d.Shipped = true
+					return "Shipped", d, nil
+				}),
+			}).ToHandler(),
+			Transitions: Transitions{
+				"Shipped": "Shipped",
+			},
+		},
+		"Shipped":  StateConfig{Parent: "Shipping", Final: true},
+		"Done":     StateConfig{Final: true},
+		"Canceled": StateConfig{Final: true},
+	}
+}
+
+func TestParallelRegions(t *testing.T) {
+	ctx := context.Background()
+	t.Run("EnterRegions", func(t *testing.T) {
+		f := newTestFlow(fulfillmentTable(), "Fulfillment", &fulfillmentData{})
+		require.Equal(t, State("Fulfillment"), f.CurrentState())
+		require.Equal(t, []State{"AwaitingPayment", "AwaitingShipment"}, f.ActiveStates())
+	})
+
+	t.Run("Join", func(t *testing.T) {
+		f := newTestFlow(fulfillmentTable(), "Fulfillment", &fulfillmentData{})
+		require.NoError(t, f.HandleAction(ctx, testAction{"Pay"}))
+		require.Equal(t, []State{"Paid", "AwaitingShipment"}, f.ActiveStates())
+		require.False(t, f.IsCompleted())
+
+		require.NoError(t, f.HandleAction(ctx, testAction{"Ship"}))
+		require.Equal(t, State("Done"), f.CurrentState())
+		require.True(t, f.IsCompleted())
+		require.Equal(t, &fulfillmentData{Paid: true, Shipped: true}, f.Data())
+	})
+
+	t.Run("HandledByParallelState", func(t *testing.T) {
+		f := newTestFlow(fulfillmentTable(), "Fulfillment", &fulfillmentData{})
+		require.NoError(t, f.HandleAction(ctx, testAction{"Pay"}))
+		require.NoError(t, f.HandleAction(ctx, testAction{"Cancel"}))
+		require.Equal(t, State("Canceled"), f.CurrentState())
+		require.Equal(t, []State{"Canceled"}, f.ActiveStates())
+		require.True(t, f.IsCompleted())
+	})
+
+	t.Run("SnapshotRoundTrip", func(t *testing.T) {
+		f := newTestFlow(fulfillmentTable(), "Fulfillment", &fulfillmentData{})
+		require.NoError(t, f.HandleAction(ctx, testAction{"Pay"}))
+		s, err := f.ToSnapshot()
+		require.NoError(t, err)
+		require.Equal(t, map[State]State{"Payment": "Paid", "Shipping": "AwaitingShipment"}, s.Regions)
+
+		restored := FromSnapshot(s, fulfillmentTable())
+		require.Equal(t, f.ActiveStates(), restored.ActiveStates())
+	})
+
+	t.Run("SingleStateSnapshot", func(t *testing.T) {
+		restored := FromSnapshot(&Snapshot{ID: "1", CurrentState: "Fulfillment"}, fulfillmentTable())
+		require.Equal(t, []State{"AwaitingPayment", "AwaitingShipment"}, restored.ActiveStates())
+
+		restored = FromSnapshot(&Snapshot{ID: "1", CurrentState: "Done"}, fulfillmentTable())
+		require.Equal(t, []State{"Done"}, restored.ActiveStates())
+	})
+}
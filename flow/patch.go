@@ -0,0 +1,99 @@
+package flow
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+)
+
+// createMergePatch returns the JSON merge patch (RFC 7386), which turns the document from into the document to.
+// It returns nil, if the documents are equal.
+//
+// Like any merge patch, it cannot set a member of an object to null, since null removes the member.
+// When the data is decoded into a struct, both have the same result.
+func createMergePatch(from json.RawMessage, to json.RawMessage) (json.RawMessage, error) {
+	source, err := decodeJSON(from)
+	if err != nil {
+		return nil, err
+	}
+	target, err := decodeJSON(to)
+	if err != nil {
+		return nil, err
+	}
+	if reflect.DeepEqual(source, target) {
+		return nil, nil
+	}
+	return json.Marshal(diffJSON(source, target))
+}
+
+// applyMergePatch applies a JSON merge patch (RFC 7386) to a document.
+func applyMergePatch(doc json.RawMessage, patch json.RawMessage) (json.RawMessage, error) {
+	target, err := decodeJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeJSON(patch)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeJSON(target, p))
+}
+
+// decodeJSON decodes a document into generic values. Numbers are kept as json.Number, so they are not rounded.
+func decodeJSON(doc json.RawMessage) (any, error) {
+	if len(doc) == 0 {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func diffJSON(source any, target any) any {
+	sourceObject, ok := source.(map[string]any)
+	if !ok {
+		return target
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		return target
+	}
+	patch := make(map[string]any)
+	for key, sourceValue := range sourceObject {
+		targetValue, ok := targetObject[key]
+		if !ok {
+			patch[key] = nil
+		} else if !reflect.DeepEqual(sourceValue, targetValue) {
+			patch[key] = diffJSON(sourceValue, targetValue)
+		}
+	}
+	for key, targetValue := range targetObject {
+		if _, ok := sourceObject[key]; !ok {
+			patch[key] = targetValue
+		}
+	}
+	return patch
+}
+
+func mergeJSON(target any, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = make(map[string]any)
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergeJSON(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
@@ -0,0 +1,25 @@
+package flow
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergePatch(t *testing.T) {
+	from := json.RawMessage(`{"Amount":10,"Address":{"City":"Berlin","Zip":"10115"},"Items":[1,2],"Note":"gift"}`)
+	to := json.RawMessage(`{"Amount":12345678901234567,"Address":{"City":"Hamburg","Zip":"10115"},"Items":[1],"Coupon":"X"}`)
+
+	patch, err := createMergePatch(from, to)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Amount":12345678901234567,"Address":{"City":"Hamburg"},"Items":[1],"Note":null,"Coupon":"X"}`, string(patch))
+
+	patched, err := applyMergePatch(from, patch)
+	require.NoError(t, err)
+	require.JSONEq(t, string(to), string(patched))
+
+	patch, err = createMergePatch(from, from)
+	require.NoError(t, err)
+	require.Nil(t, patch)
+}
@@ -0,0 +1,140 @@
+package flow
+
+import (
+	"context"
+	"sort"
+
+	"github.com/necrobits/x/errors"
+)
+
+// AvailableEvents returns the events, which have a transition from the active states of the flow, sorted by name.
+// It includes the transitions of the ancestors, and the global transitions of [AnyState].
+// A completed, expired or compensating flow has no available events.
+func (f *Flow) AvailableEvents() []Event {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.checkAccepting("") != nil {
+		return nil
+	}
+	seen := make(map[Event]bool)
+	events := make([]Event, 0)
+	add := func(event Event) {
+		if !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+	for _, state := range f.activeStates() {
+		for _, s := range f.states.transitionPath(state) {
+			for event := range f.states[s].Transitions {
+				add(event)
+			}
+			for event := range f.states[s].GuardedTransitions {
+				add(event)
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i] < events[j] })
+	return events
+}
+
+// AvailableActions returns the action types, which are declared by the active states of the flow
+// and their ancestors, sorted by name. See [StateConfig.Actions].
+// While a child flow is running, its available actions are included, since actions are forwarded to it.
+// A completed, expired or compensating flow has no available actions.
+func (f *Flow) AvailableActions() []ActionType {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.checkAccepting("") != nil {
+		return nil
+	}
+	seen := make(map[ActionType]bool)
+	actions := make([]ActionType, 0)
+	add := func(actionType ActionType) {
+		if !seen[actionType] {
+			seen[actionType] = true
+			actions = append(actions, actionType)
+		}
+	}
+	for _, state := range f.activeStateSet() {
+		for _, actionType := range f.states[state].Actions {
+			add(actionType)
+		}
+	}
+	if f.childRunning() {
+		for _, actionType := range f.child.AvailableActions() {
+			add(actionType)
+		}
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i] < actions[j] })
+	return actions
+}
+
+// CanHandle reports whether the flow accepts the action in its current condition, without handling it.
+// If not, the error is the one, which HandleAction would return before calling a handler.
+//
+// CanHandle does not call any handler or middleware. It checks that the type of the action is declared
+// by one of the active states or their ancestors, see [StateConfig.Actions], or that a running child flow accepts it.
+// The event returned by the handler cannot be known in advance, so the transition and its guards are not checked.
+//
+// Like HandleAction, CanHandle follows the expiration transition of an expired flow first, see [Flow.Expire].
+// The action is then checked in the target of the expiration transition, without its automatic transitions.
+func (f *Flow) CanHandle(ctx context.Context, a Action) (bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if err := f.checkAction(ctx, a); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// checkAction checks an action against the declared actions of the active states, or of the state reached by the expiration transition.
+func (f *Flow) checkAction(ctx context.Context, a Action) error {
+	if !f.completed && !f.compensating && f.isExpired() && f.hasExpirationTransition() {
+		nextState, err := f.resolveExpiration(ctx)
+		if err != nil {
+			return expiredError("flow.CanHandle")
+		}
+		if f.states[nextState].Final {
+			return errors.B().
+				Code(ErrFlowCompleted).
+				Op("flow.CanHandle").
+				Msg("flow is completed").Build()
+		}
+		return f.checkDeclared(f.enteredStateSet(nextState), a.Type())
+	}
+	if err := f.checkAccepting(a.Type()); err != nil {
+		return err
+	}
+	if f.childRunning() {
+		if _, err := f.child.CanHandle(ctx, a); !errors.Is(err, ErrNoRoute) {
+			return err
+		}
+	}
+	return f.checkDeclared(f.activeStateSet(), a.Type())
+}
+
+// checkDeclared returns an error, if none of the states declares the action type.
+func (f *Flow) checkDeclared(states []State, actionType ActionType) error {
+	for _, state := range states {
+		for _, declared := range f.states[state].Actions {
+			if declared == actionType {
+				return nil
+			}
+		}
+	}
+	return errors.B().
+		Code(ErrNoRoute).
+		Op("flow.CanHandle").
+		Msgf("action %s is not declared by the active states", actionType).Build()
+}
+
+// enteredStateSet returns the states, which are active after entering a state, including their ancestors, like activeStateSet.
+func (f *Flow) enteredStateSet(state State) []State {
+	states := f.states.Path(state)
+	depth := len(states)
+	for _, region := range f.states[state].Regions {
+		states = append(states, f.states.Path(f.states.InitialLeaf(region))[depth:]...)
+	}
+	return states
+}
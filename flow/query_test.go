@@ -0,0 +1,130 @@
+package flow
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/necrobits/x/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueries(t *testing.T) {
+	ctx := context.Background()
+	payment := NewRouter(ActionRoutes{
+		"Pay": func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+			return "Paid", &orderData{Amount: data.(*orderData).Amount + 100}, nil
+		},
+		"Cancel": emit("Canceled"),
+	})
+	shipping := NewRouter(ActionRoutes{"Ship": emit("Shipped")})
+	table := TransitionTable{
+		"AwaitingPayment": StateConfig{
+			Handler:     payment.ToHandler(),
+			Actions:     payment.ActionTypes(),
+			Transitions: Transitions{"Paid": "Shipping"},
+		},
+		"Shipping": StateConfig{
+			Handler: shipping.ToHandler(),
+			Actions: shipping.ActionTypes(),
+			GuardedTransitions: GuardedTransitions{
+				"Shipped": {{Target: "Delivered", Guard: TypedGuard(func(d *orderData) bool { return d.Amount > 0 })}},
+			},
+		},
+		"Delivered": StateConfig{Final: true},
+		"Canceled":  StateConfig{Final: true},
+		AnyState: StateConfig{
+			Transitions: Transitions{"Canceled": "Canceled"},
+		},
+	}
+	t.Run("Available", func(t *testing.T) {
+		f := newTestFlow(table, "AwaitingPayment", &orderData{})
+		require.Equal(t, []Event{"Canceled", "Paid"}, f.AvailableEvents())
+		require.Equal(t, []ActionType{"Cancel", "Pay"}, f.AvailableActions())
+
+		require.NoError(t, f.HandleAction(ctx, testAction{"Cancel"}))
+		require.Empty(t, f.AvailableEvents())
+		require.Empty(t, f.AvailableActions())
+	})
+
+	t.Run("CanHandle", func(t *testing.T) {
+		f := newTestFlow(table, "AwaitingPayment", &orderData{})
+		hookCalls := 0
+		f.RegisterPreTransition("Shipping", func(ctx context.Context, data FlowData) error {
+			hookCalls++
+			return nil
+		})
+		ok, err := f.CanHandle(ctx, testAction{"Pay"})
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, State("AwaitingPayment"), f.CurrentState())
+		require.Equal(t, &orderData{}, f.Data())
+		require.Zero(t, hookCalls)
+		require.Zero(t, f.Revision())
+
+		ok, err = f.CanHandle(ctx, testAction{"Ship"})
+		require.False(t, ok)
+		require.True(t, errors.Is(err, ErrNoRoute))
+	})
+
+	t.Run("CanHandleWithoutCalls", func(t *testing.T) {
+		calls := 0
+		count := func(next ActionHandler) ActionHandler {
+			return func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+				calls++
+				return next(ctx, data, a)
+			}
+		}
+		f := New(CreateFlowOpts{
+			InitialState: "AwaitingPayment",
+			Data:         &orderData{Amount: 10},
+			Middlewares:  []Middleware{count},
+			TransitionTable: TransitionTable{
+				"AwaitingPayment": StateConfig{
+					Handler: func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+						calls++
+						return "Paid", data, nil
+					},
+					Actions:     []ActionType{"Pay"},
+					Transitions: Transitions{"Paid": "Shipping"},
+				},
+				"Shipping": StateConfig{Final: true},
+			},
+		})
+		ok, err := f.CanHandle(ctx, testAction{"Pay"})
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Zero(t, calls)
+	})
+
+	t.Run("CanHandleGuards", func(t *testing.T) {
+		f := newTestFlow(table, "Shipping", &orderData{})
+		ok, err := f.CanHandle(ctx, testAction{"Ship"})
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.True(t, errors.Is(f.HandleAction(ctx, testAction{"Ship"}), ErrNoPassingGuard))
+	})
+
+	t.Run("CanHandleExpired", func(t *testing.T) {
+		f := newTestFlow(table, "AwaitingPayment", &orderData{Amount: 10})
+		f.SetExpirationAt(time.Now().Add(-time.Minute))
+		ok, err := f.CanHandle(ctx, testAction{"Pay"})
+		require.False(t, ok)
+		require.True(t, errors.Is(err, ErrFlowExpired))
+
+		f.WithExpiration("", "Shipping")
+		ok, err = f.CanHandle(ctx, testAction{"Ship"})
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.True(t, f.IsExpired())
+		require.NoError(t, f.HandleAction(ctx, testAction{"Ship"}))
+
+		f = newTestFlow(table, "AwaitingPayment", &orderData{})
+		f.SetExpirationAt(time.Now().Add(-time.Minute))
+		f.WithExpiration("Canceled", "")
+		ok, err = f.CanHandle(ctx, testAction{"Pay"})
+		require.False(t, ok)
+		require.True(t, errors.Is(err, ErrFlowCompleted))
+		require.True(t, errors.Is(f.HandleAction(ctx, testAction{"Pay"}), ErrFlowCompleted))
+	})
+}
@@ -0,0 +1,131 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/necrobits/x/errors"
+)
+
+// PanicError is the cause of an error with the code [ErrPanic]. It contains the recovered value and the stack of the panic.
+// It can be retrieved with the standard errors.As:
+//
+//	var p *flow.PanicError
+//	if stderrors.As(err, &p) {
+//		log.Printf("handler panicked: %v\n%s", p.Value, p.Stack)
+//	}
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value any
+	// Stack is the stack trace of the goroutine at the time of the panic.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// panicError converts a recovered panic of a handler or a hook into an error with the code ErrPanic.
+func panicError(op string, source string, value any) error {
+	return errors.B().
+		Code(ErrPanic).
+		Op(op).
+		Msgf("%s panicked", source).
+		Err(&PanicError{Value: value, Stack: debug.Stack()}).Build()
+}
+
+// recoverHandler turns a panic of the handler, or of its middlewares, into an error.
+// The flow remains in its state, as if the handler had returned the error.
+func recoverHandler(handler ActionHandler) ActionHandler {
+	return func(ctx context.Context, data FlowData, a Action) (event Event, nextData FlowData, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				event, nextData = NoEvent, data
+				err = panicError("flow.HandleAction", fmt.Sprintf("action handler of %s", a.Type()), r)
+			}
+		}()
+		return handler(ctx, data, a)
+	}
+}
+
+// callHook calls a hook, which can abort a transition, and turns its panic into an error.
+func callHook(ctx context.Context, source string, hook hookFn, data FlowData) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError("flow.HandleAction", source, r)
+		}
+	}()
+	return hook(ctx, data)
+}
+
+// callGuard calls a guard, and turns its panic into an error.
+func callGuard(ctx context.Context, event Event, guard Guard, data FlowData) (passed bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = panicError("flow.HandleAction", fmt.Sprintf("guard of %s", event), r)
+		}
+	}()
+	return guard(ctx, data), nil
+}
+
+// callSilentHook calls a post-transition or completion hook. Since the transition has already happened,
+// a panic cannot abort it. Instead, it is logged and passed to the OnHookPanic callback of the flow,
+// and the remaining hooks are called as usual.
+func (f *Flow) callSilentHook(ctx context.Context, source string, hook silentHookFn, data FlowData) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := panicError("flow.HandleAction", source, r)
+			f.logf("Error: %v\n", err)
+			if f.onHookPanic != nil {
+				f.notifyHookPanic(ctx, err)
+			}
+		}
+	}()
+	hook(ctx, data)
+}
+
+// notifyHookPanic passes the panic of a hook to the OnHookPanic callback. A panic of the callback is only logged,
+// so it cannot escape the flow either.
+func (f *Flow) notifyHookPanic(ctx context.Context, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			f.logf("Error: %v\n", panicError("flow.HandleAction", "OnHookPanic callback", r))
+		}
+	}()
+	f.onHookPanic(ctx, err)
+}
+
+// WithOnHookPanic sets the callback, which receives the recovered panic of a post-transition or completion hook
+// as an error with the code [ErrPanic]. The panic does not fail the action, because the transition has already happened.
+// The callback is called while the flow is locked, so it must not call the methods of the flow.
+// A panic of the callback is recovered and logged.
+// This is useful for flows restored from a snapshot, see [CreateFlowOpts.OnHookPanic].
+func (f *Flow) WithOnHookPanic(onHookPanic func(ctx context.Context, err error)) *Flow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onHookPanic = onHookPanic
+	return f
+}
+
+// callCompensation calls a compensation handler, and turns its panic into an error.
+func callCompensation(ctx context.Context, state State, compensate CompensationHandler, data FlowData) (nextData FlowData, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			nextData = data
+			err = panicError("flow.Compensate", fmt.Sprintf("compensation of %s", state), r)
+		}
+	}()
+	return compensate(ctx, data)
+}
+
+// callHydrationHook calls a hydration hook, and turns its panic into an error.
+func callHydrationHook(ctx context.Context, hook hydrationHookFn, data FlowData) (nextData FlowData, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			nextData = data
+			err = panicError("flow.Hydrate", "hydration hook", r)
+		}
+	}()
+	return hook(ctx, data)
+}
@@ -0,0 +1,146 @@
+package flow
+
+import (
+	"context"
+	stderrors "errors"
+	"testing"
+	"time"
+
+	"github.com/necrobits/x/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPanicRecovery(t *testing.T) {
+	ctx := context.Background()
+	table := func(handler ActionHandler, onEntry hookFn) TransitionTable {
+		return TransitionTable{
+			"AwaitingPayment": StateConfig{
+				Handler:     handler,
+				Transitions: Transitions{"Paid": "Completed"},
+			},
+			"Completed": StateConfig{Final: true, OnEntry: onEntry},
+		}
+	}
+
+	t.Run("Handler", func(t *testing.T) {
+		f := New(CreateFlowOpts{
+			InitialState: "AwaitingPayment",
+			TransitionTable: table(func(ctx context.Context, data FlowData, a Action) (Event, FlowData, error) {
+				panic("payment provider unavailable")
+			}, nil),
+		})
+		err := f.HandleAction(ctx, testAction{"Pay"})
+		require.True(t, errors.Is(err, ErrPanic))
+		var p *PanicError
+		require.True(t, stderrors.As(err, &p))
+		require.Equal(t, "payment provider unavailable", p.Value)
+		require.NotEmpty(t, p.Stack)
+		require.Equal(t, State("AwaitingPayment"), f.CurrentState())
+		require.Equal(t, uint64(0), f.Revision())
+	})
+
+	t.Run("OnEntry", func(t *testing.T) {
+		f := New(CreateFlowOpts{
+			InitialState: "AwaitingPayment",
+			TransitionTable: table(emit("Paid"), func(ctx context.Context, data FlowData) error {
+				panic("receipt printer on fire")
+			}),
+		})
+		err := f.HandleAction(ctx, testAction{"Pay"})
+		require.True(t, errors.Is(err, ErrPanic))
+		require.Equal(t, State("AwaitingPayment"), f.CurrentState())
+		require.False(t, f.IsCompleted())
+	})
+
+	t.Run("PostTransitionHook", func(t *testing.T) {
+		var hookErr error
+		f := New(CreateFlowOpts{
+			InitialState:    "AwaitingPayment",
+			TransitionTable: table(emit("Paid"), nil),
+			Data:            &orderData{Amount: 10},
+			OnHookPanic:     func(ctx context.Context, err error) { hookErr = err },
+		})
+		var notified, completed bool
+		f.RegisterPostTransition("Completed", TypedHook(func(d orderData) {}))
+		f.RegisterPostTransition("Completed", TypedHook(func(d *orderData) { notified = true }))
+		f.RegisterCompletionHook("Completed", TypedHook(func(d *orderData) { completed = true }))
+		require.NoError(t, f.HandleAction(ctx, testAction{"Pay"}))
+		require.True(t, errors.Is(hookErr, ErrPanic))
+		require.True(t, notified)
+		require.True(t, completed)
+		require.Equal(t, State("Completed"), f.CurrentState())
+		require.Equal(t, uint64(1), f.Revision())
+	})
+
+	t.Run("Guard", func(t *testing.T) {
+		f := newTestFlow(TransitionTable{
+			"AwaitingPayment": StateConfig{
+				Handler: emit("Paid"),
+				GuardedTransitions: GuardedTransitions{
+					"Paid": {{Target: "Completed", Guard: func(ctx context.Context, data FlowData) bool {
+						panic("fraud check unavailable")
+					}}},
+				},
+			},
+			"Completed": StateConfig{Final: true},
+		}, "AwaitingPayment", &orderData{})
+		err := f.HandleAction(ctx, testAction{"Pay"})
+		require.True(t, errors.Is(err, ErrPanic))
+		require.Equal(t, State("AwaitingPayment"), f.CurrentState())
+	})
+
+	t.Run("OnHookPanicCallback", func(t *testing.T) {
+		f := New(CreateFlowOpts{
+			InitialState:    "AwaitingPayment",
+			TransitionTable: table(emit("Paid"), nil),
+			OnHookPanic:     func(ctx context.Context, err error) { panic("alerting unavailable") },
+		})
+		f.RegisterPostTransition("Completed", func(ctx context.Context, data FlowData) {
+			panic("notification failed")
+		})
+		require.NoError(t, f.HandleAction(ctx, testAction{"Pay"}))
+		require.Equal(t, State("Completed"), f.CurrentState())
+	})
+}
+
+func TestErrorCodes(t *testing.T) {
+	ctx := context.Background()
+	table := TransitionTable{
+		"AwaitingPayment": StateConfig{
+			Handler:     emit("Paid"),
+			Transitions: Transitions{"Refunded": "Completed"},
+		},
+		"Delivered": StateConfig{
+			Handler:     emit("Confirmed"),
+			Transitions: Transitions{"Confirmed": "Completed"},
+		},
+		"Shipping": StateConfig{
+			Transitions: Transitions{"Shipped": "Completed"},
+		},
+		"Completed": StateConfig{Final: true},
+	}
+
+	t.Run("NoTransition", func(t *testing.T) {
+		err := newTestFlow(table, "AwaitingPayment", nil).HandleAction(ctx, testAction{"Pay"})
+		require.True(t, errors.Is(err, ErrNoTransition))
+	})
+
+	t.Run("NoHandler", func(t *testing.T) {
+		err := newTestFlow(table, "Shipping", nil).HandleAction(ctx, testAction{"Pay"})
+		require.True(t, errors.Is(err, ErrNoHandler))
+	})
+
+	t.Run("Completed", func(t *testing.T) {
+		f := newTestFlow(table, "Delivered", nil)
+		require.NoError(t, f.HandleAction(ctx, testAction{"Confirm"}))
+		err := f.HandleAction(ctx, testAction{"Pay"})
+		require.True(t, errors.Is(err, ErrFlowCompleted))
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		f := newTestFlow(table, "AwaitingPayment", nil)
+		f.SetExpirationAt(time.Now().Add(-time.Minute))
+		err := f.HandleAction(ctx, testAction{"Pay"})
+		require.True(t, errors.Is(err, ErrFlowExpired))
+	})
+}
@@ -24,3 +24,35 @@ type StateMachine interface {
 	RegisterPostTransition(state State, hook silentHookFn)
 	RegisterCompletionHook(state State, hook silentHookFn)
 }
+
+// Ticker is a state machine with timers, see [Flow.Tick].
+type Ticker interface {
+	Tick(ctx context.Context, now time.Time) error
+	Deadlines() []Deadline
+}
+
+// Expirer is a state machine with an expiration transition, see [Flow.Expire].
+type Expirer interface {
+	Expire(ctx context.Context, now time.Time) error
+}
+
+// Compensator is a state machine, which can undo its completed states, see [Flow.Compensate].
+type Compensator interface {
+	Compensate(ctx context.Context) error
+	IsCompensating() bool
+}
+
+// Querier answers questions about the active states of a state machine, without changing it.
+type Querier interface {
+	CanHandle(ctx context.Context, a Action) (bool, error)
+	AvailableEvents() []Event
+	AvailableActions() []ActionType
+	CurrentStatePath() []State
+	ActiveStates() []State
+}
+
+// Recorder is a state machine, which keeps track of its changes, see [Flow.History] and [Flow.Revision].
+type Recorder interface {
+	History() []HistoryEntry
+	Revision() uint64
+}
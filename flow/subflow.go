@@ -0,0 +1,176 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/necrobits/x/errors"
+)
+
+// SubFlow invokes a child flow of another type, while the flow is in a state.
+// For example, to reuse a KYC flow in a signup flow:
+//
+//	VerifyingIdentity: flow.StateConfig{
+//		Invoke: &flow.SubFlow{
+//			Definition:    kycDefinition,
+//			Input:         func(data flow.FlowData) flow.FlowData { return &KycData{UserID: data.(*SignupData).UserID} },
+//			OnSuccess:     IdentityVerified,
+//			OnFailure:     IdentityRejected,
+//			FailureStates: []flow.State{KycRejected},
+//		},
+//		Transitions: flow.Transitions{
+//			IdentityVerified: Active,
+//			IdentityRejected: Rejected,
+//		},
+//	}
+//
+// The child flow is created when the state is entered, and discarded when the state is exited.
+// While the child flow runs, actions are handled by the child flow first. If the child flow has no route
+// for an action, it is handled by the flow itself. When the child flow completes, the flow raises the mapped event.
+// The child flow is part of the [Snapshot] of the flow, so both are restored together.
+// Sub-flows are not supported in the regions of a parallel state.
+type SubFlow struct {
+	// Definition is the definition of the child flow. It is used to create and restore the child flow.
+	Definition *Definition
+	// Input creates the initial data of the child flow from the data of the flow. If it is nil, the child flow has no data.
+	Input func(data FlowData) FlowData
+	// Output merges the data of the completed child flow into the data of the flow, before the mapped event is raised.
+	// If it is nil, the data of the flow is not changed.
+	Output func(data FlowData, childData FlowData) FlowData
+	// OnSuccess is the event, which is raised when the child flow completes in a final state, which is not in FailureStates.
+	OnSuccess Event
+	// OnFailure is the event, which is raised when the child flow completes in one of FailureStates.
+	OnFailure Event
+	// FailureStates are the final states of the child flow, which are considered as a failure.
+	FailureStates []State
+}
+
+// Child returns the running child flow, or nil if the current state does not invoke a sub-flow.
+func (f *Flow) Child() *Flow {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.child
+}
+
+// updateChild discards the child flow when its invoking state is exited,
+// and starts a child flow when an entered state invokes one. The innermost invoking state wins.
+func (f *Flow) updateChild(exited []State, entered []State) {
+	if f.child != nil && containsState(exited, f.childState) {
+		f.logf("Discarding child flow %s\n", f.child.ID())
+		f.child = nil
+		f.childState = ""
+	}
+	for _, state := range entered {
+		invoke := f.states[state].Invoke
+		if invoke == nil {
+			continue
+		}
+		var data FlowData
+		if invoke.Input != nil {
+			data = invoke.Input(f.data)
+		}
+		f.child = invoke.Definition.New(fmt.Sprintf("%s/%s", f.id, state), data)
+		f.childState = state
+		f.logf("Started child flow %s\n", f.child.ID())
+	}
+}
+
+// invokingState returns the innermost active state, which invokes a sub-flow.
+func (f *Flow) invokingState() (State, *SubFlow) {
+	return f.states.invoker(f.currentState)
+}
+
+// invoker returns the innermost state in the path of a state, which invokes a sub-flow.
+func (t TransitionTable) invoker(state State) (State, *SubFlow) {
+	path := t.Path(state)
+	for i := len(path) - 1; i >= 0; i-- {
+		if invoke := t[path[i]].Invoke; invoke != nil {
+			return path[i], invoke
+		}
+	}
+	return "", nil
+}
+
+// restoreChild restores the child flow from its snapshot, whose data is already decoded.
+// The snapshot is migrated together with the snapshot of the flow, so it is not migrated here.
+func (f *Flow) restoreChild(s *Snapshot) {
+	f.child, f.childState = nil, ""
+	if s == nil {
+		return
+	}
+	state, invoke := f.invokingState()
+	if invoke == nil {
+		return
+	}
+	f.child = invoke.Definition.restore(s)
+	f.childState = state
+}
+
+func (f *Flow) childRunning() bool {
+	return f.child != nil && !f.child.IsCompleted()
+}
+
+// handleChildAction forwards an action to the running child flow.
+// It reports whether the child flow has handled the action. If not, the action is handled by the flow itself.
+// It also reports whether an automatic transition is pending afterwards.
+func (f *Flow) handleChildAction(ctx context.Context, a Action, now time.Time) (bool, bool, error) {
+	if _, ok := a.(autopassAction); ok {
+		return false, false, nil
+	}
+	f.logf("Forwarding action: %s to child flow %s\n", a.Type(), f.child.ID())
+	revision := f.child.Revision()
+	err := f.child.HandleAction(ctx, a)
+	if errors.Is(err, ErrNoRoute) {
+		return false, false, nil
+	}
+	f.journaling.changed = f.journaling.changed || f.child.Revision() != revision
+	c := cause{action: a.Type(), from: f.currentState, at: now}
+	if err != nil {
+		f.logf("Error in child flow: %v\n", err)
+		return true, false, f.recordError(c, err)
+	}
+	pending, err := f.completeChild(ctx, c)
+	return true, pending, err
+}
+
+// tickChild fires the due timers of the running child flow.
+// It reports whether the child flow has changed, and whether an automatic transition is pending afterwards.
+func (f *Flow) tickChild(ctx context.Context, now time.Time) (bool, bool, error) {
+	revision := f.child.Revision()
+	err := f.child.Tick(ctx, now)
+	changed := f.child.Revision() != revision
+	f.journaling.changed = f.journaling.changed || changed
+	if err != nil {
+		return changed, false, err
+	}
+	pending, err := f.completeChild(ctx, cause{from: f.currentState, at: now})
+	return changed, pending, err
+}
+
+// completeChild raises the mapped event, if the child flow has completed.
+func (f *Flow) completeChild(ctx context.Context, c cause) (bool, error) {
+	if !f.child.IsCompleted() {
+		return false, nil
+	}
+	invoke := f.states[f.childState].Invoke
+	c.event = invoke.OnSuccess
+	if containsState(invoke.FailureStates, f.child.CurrentState()) {
+		c.event = invoke.OnFailure
+	}
+	f.logf("Child flow %s completed in state: %s\n", f.child.ID(), f.child.CurrentState())
+	data := f.data
+	if invoke.Output != nil {
+		data = invoke.Output(f.data, f.child.Data())
+	}
+	if c.event == NoEvent {
+		f.setData(data)
+		return false, nil
+	}
+	nextState, err := f.resolveTransition(ctx, f.currentState, c.event, data)
+	if err != nil {
+		f.logf("Error: %v\n", err)
+		return false, f.recordError(c, err)
+	}
+	return f.transition(ctx, c, data, nextState)
+}
@@ -0,0 +1,142 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type kycData struct {
+	UserID string
+}
+
+type signupData struct {
+	UserID   string
+	Verified bool
+}
+
+func kycDefinition() *Definition {
+	return &Definition{
+		Type:         "Kyc",
+		InitialState: "Collecting",
+		TransitionTable: TransitionTable{
+			"Collecting": StateConfig{
+				Handler:     NewRouter(ActionRoutes{"SubmitDocument": emit("Submitted")}).ToHandler(),
+				Transitions: Transitions{"Submitted": "Checking"},
+			},
+			"Checking": StateConfig{
+				Handler: NewRouter(ActionRoutes{
+					"Approve": emit("Approved"),
+					"Reject":  emit("Rejected"),
+				}).ToHandler(),
+				Transitions: Transitions{"Approved": "Verified", "Rejected": "Rejected"},
+			},
+			"Verified": StateConfig{Final: true},
+			"Rejected": StateConfig{Final: true},
+		},
+		DecodeData: func(data json.RawMessage) (FlowData, error) {
+			kyc := &kycData{}
+			return kyc, json.Unmarshal(data, kyc)
+		},
+	}
+}
+
+func signupTable() TransitionTable {
+	return TransitionTable{
+		"Registering": StateConfig{
+			Handler:     emit("Registered"),
+			Transitions: Transitions{"Registered": "Verifying"},
+		},
+		"Verifying": StateConfig{
+			Handler: NewRouter(ActionRoutes{"Cancel": emit("Canceled")}).ToHandler(),
+			Invoke: &SubFlow{
+				Definition: kycDefinition(),
+				Input: func(data FlowData) FlowData {
+					return &kycData{UserID: data.(*signupData).UserID}
+				},
+				Output: func(data FlowData, childData FlowData) FlowData {
+					signup := *data.(*signupData)
+					signup.Verified = true
+					return &signup
+				},
+				OnSuccess:     "IdentityVerified",
+				OnFailure:     "IdentityRejected",
+				FailureStates: []State{"Rejected"},
+			},
+			Transitions: Transitions{
+				"IdentityVerified": "Active",
+				"IdentityRejected": "Blocked",
+				"Canceled":         "Canceled",
+			},
+		},
+		"Active":   StateConfig{Final: true},
+		"Blocked":  StateConfig{Final: true},
+		"Canceled": StateConfig{Final: true},
+	}
+}
+
+// verifyingSignup creates a signup flow, which has started its child flow in the state Verifying.
+func verifyingSignup(t *testing.T) *Flow {
+	f := newTestFlow(signupTable(), "Registering", &signupData{UserID: "u1"})
+	require.Nil(t, f.Child())
+	require.NoError(t, f.HandleAction(context.Background(), testAction{"Register"}))
+	require.Equal(t, State("Verifying"), f.CurrentState())
+	require.NotNil(t, f.Child())
+	require.Equal(t, "1/Verifying", f.Child().ID())
+	require.Equal(t, &kycData{UserID: "u1"}, f.Child().Data())
+	return f
+}
+
+func TestSubFlow(t *testing.T) {
+	ctx := context.Background()
+	t.Run("Success", func(t *testing.T) {
+		f := verifyingSignup(t)
+		require.NoError(t, f.HandleAction(ctx, testAction{"SubmitDocument"}))
+		require.Equal(t, State("Verifying"), f.CurrentState())
+		require.Equal(t, State("Checking"), f.Child().CurrentState())
+		require.NoError(t, f.HandleAction(ctx, testAction{"Approve"}))
+		require.Equal(t, State("Active"), f.CurrentState())
+		require.Nil(t, f.Child())
+		require.Equal(t, &signupData{UserID: "u1", Verified: true}, f.Data())
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		f := verifyingSignup(t)
+		require.NoError(t, f.HandleAction(ctx, testAction{"SubmitDocument"}))
+		require.NoError(t, f.HandleAction(ctx, testAction{"Reject"}))
+		require.Equal(t, State("Blocked"), f.CurrentState())
+	})
+
+	t.Run("HandledByParent", func(t *testing.T) {
+		f := verifyingSignup(t)
+		require.NoError(t, f.HandleAction(ctx, testAction{"Cancel"}))
+		require.Equal(t, State("Canceled"), f.CurrentState())
+		require.Nil(t, f.Child())
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		f := verifyingSignup(t)
+		require.NoError(t, f.HandleAction(ctx, testAction{"SubmitDocument"}))
+		snapshot, err := f.ToSnapshot()
+		require.NoError(t, err)
+		require.NotNil(t, snapshot.Child)
+		encoded, err := json.Marshal(snapshot)
+		require.NoError(t, err)
+
+		var decoded Snapshot
+		require.NoError(t, json.Unmarshal(encoded, &decoded))
+		signup := &signupData{}
+		require.NoError(t, json.Unmarshal(decoded.EncodedData, signup))
+		decoded.Data = signup
+		decoded.Child.Data, err = kycDefinition().DecodeData(decoded.Child.EncodedData)
+		require.NoError(t, err)
+
+		restored := FromSnapshot(&decoded, signupTable())
+		require.Equal(t, State("Checking"), restored.Child().CurrentState())
+		require.Equal(t, &kycData{UserID: "u1"}, restored.Child().Data())
+		require.NoError(t, restored.HandleAction(ctx, testAction{"Approve"}))
+		require.Equal(t, State("Active"), restored.CurrentState())
+	})
+}
@@ -0,0 +1,195 @@
+package flow
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Timer fires an event, when the flow has stayed in a state for a duration.
+// For example, to cancel an order which is not paid within 15 minutes:
+//
+//	AwaitingPayment: flow.StateConfig{
+//		After: []flow.Timer{
+//			{Delay: 15 * time.Minute, Event: PaymentTimedOut},
+//		},
+//		Transitions: flow.Transitions{
+//			PaymentTimedOut: Canceled,
+//		},
+//	}
+type Timer struct {
+	// Delay is the duration after entering the state, at which the event is fired.
+	Delay time.Duration
+	// Event is the event to fire. It is resolved like an event returned by an action handler.
+	Event Event
+}
+
+// Deadline is a pending timer of an active state.
+type Deadline struct {
+	// State is the state, which started the timer.
+	State State `json:"state"`
+	// Event is the event to fire.
+	Event Event `json:"event"`
+	// DueAt is the time at which the event is fired.
+	DueAt time.Time `json:"due_at"`
+}
+
+// Tick fires the events of the timers, which are due at the given time.
+// The events are fired in the order of their deadlines, and go through the same transitions and hooks as
+// the events returned by action handlers. A timer is removed before its event is fired, so it is fired at most once.
+// The states entered by the fired events start their timers at the given time, not at the time of the call,
+// so Tick can be driven by a simulated clock.
+// Since the deadlines are part of the [Snapshot], Tick can be called on a restored flow as well.
+// If any timer is fired, the revision of the flow is incremented, even if its event fails, since the timer has been removed.
+// If the flow has a journal, the fired timers and the resulting transitions are appended to it.
+func (f *Flow) Tick(ctx context.Context, now time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.journaling.reset()
+	fired, err := f.tick(ctx, now)
+	f.updateRevision(fired)
+	return f.appendJournal(ctx, nil, err)
+}
+
+// tick fires the due timers, and reports whether any timer has been fired.
+func (f *Flow) tick(ctx context.Context, now time.Time) (bool, error) {
+	fired := false
+	if f.compensating {
+		// The timers of a compensating flow are not fired, until the compensation has finished.
+		return false, nil
+	}
+	if expired, err := f.expire(ctx, now); expired || err != nil {
+		// The timers of the states left by the expiration are not fired anymore.
+		return expired, err
+	}
+	if f.childRunning() && !f.completed && !f.isExpiredAt(now) {
+		changed, pending, err := f.tickChild(ctx, now)
+		fired = changed
+		if err := f.runAutomaticTransitions(ctx, pending, err, now); err != nil {
+			return fired, err
+		}
+	}
+	for {
+		if f.completed {
+			return fired, nil
+		}
+		if f.isExpiredAt(now) {
+			return fired, expiredError("flow.Tick")
+		}
+		deadline, ok := f.nextDueDeadline(now)
+		if !ok {
+			return fired, nil
+		}
+		fired = true
+		f.journaling.fire(deadline)
+		pending, err := f.fireTimer(ctx, deadline, now)
+		if err := f.runAutomaticTransitions(ctx, pending, err, now); err != nil {
+			return fired, err
+		}
+	}
+}
+
+// Deadlines returns the pending timers of the active states, ordered by their due time.
+func (f *Flow) Deadlines() []Deadline {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.copyDeadlines()
+}
+
+func (f *Flow) copyDeadlines() []Deadline {
+	if len(f.deadlines) == 0 {
+		return nil
+	}
+	return append([]Deadline(nil), f.deadlines...)
+}
+
+// nextDueDeadline removes and returns the earliest deadline, which is due at the given time.
+func (f *Flow) nextDueDeadline(now time.Time) (Deadline, bool) {
+	if len(f.deadlines) == 0 || f.deadlines[0].DueAt.After(now) {
+		return Deadline{}, false
+	}
+	deadline := f.deadlines[0]
+	f.deadlines = f.deadlines[1:]
+	return deadline, true
+}
+
+// fireTimer fires the event of a timer from the active states of the flow at the given time.
+// If the timer belongs to a region of a parallel state, only that region is affected.
+// It reports whether an automatic transition is pending afterwards.
+func (f *Flow) fireTimer(ctx context.Context, deadline Deadline, now time.Time) (bool, error) {
+	f.logf("Timer fired: <Event>%s in state: %s\n", deadline.Event, deadline.State)
+	if f.inParallelState() {
+		for _, region := range f.states[f.currentState].Regions {
+			if !f.states.contains(region, deadline.State) {
+				continue
+			}
+			state := f.regions[region]
+			c := cause{event: deadline.Event, from: state, at: now}
+			nextState, err := f.resolveTransition(ctx, state, deadline.Event, f.data)
+			if err != nil {
+				f.logf("Error: %v\n", err)
+				return false, f.recordError(c, err)
+			}
+			inRegion, err := f.checkRegionTransition(region, state, nextState)
+			if err != nil {
+				return false, f.recordError(c, err)
+			}
+			if !inRegion {
+				return f.transition(ctx, c, f.data, nextState)
+			}
+			if err := f.runTransitionHooks(ctx, f.data, state, nextState); err != nil {
+				return false, f.recordError(c, err)
+			}
+			return f.commitRegionTransitions(ctx, f.data, []regionTransition{{region: region, cause: c, to: nextState}}), nil
+		}
+	}
+	c := cause{event: deadline.Event, from: f.currentState, at: now}
+	nextState, err := f.resolveTransition(ctx, f.currentState, deadline.Event, f.data)
+	if err != nil {
+		f.logf("Error: %v\n", err)
+		return false, f.recordError(c, err)
+	}
+	return f.transition(ctx, c, f.data, nextState)
+}
+
+// updateDeadlines stops the timers of the exited states, and starts the timers of the entered states at the given time.
+func (f *Flow) updateDeadlines(exited []State, entered []State, now time.Time) {
+	deadlines := make([]Deadline, 0, len(f.deadlines))
+	for _, deadline := range f.deadlines {
+		if !containsState(exited, deadline.State) {
+			deadlines = append(deadlines, deadline)
+		}
+	}
+	for _, state := range entered {
+		for _, timer := range f.states[state].After {
+			deadlines = append(deadlines, Deadline{
+				State: state,
+				Event: timer.Event,
+				DueAt: now.Add(timer.Delay),
+			})
+		}
+	}
+	sort.SliceStable(deadlines, func(i, j int) bool {
+		return deadlines[i].DueAt.Before(deadlines[j].DueAt)
+	})
+	f.deadlines = deadlines
+}
+
+// removeDeadline removes a pending timer, e.g. when it has been fired.
+func (f *Flow) removeDeadline(deadline Deadline) {
+	for i, d := range f.deadlines {
+		if d.State == deadline.State && d.Event == deadline.Event && d.DueAt.Equal(deadline.DueAt) {
+			f.deadlines = append(f.deadlines[:i:i], f.deadlines[i+1:]...)
+			return
+		}
+	}
+}
+
+func containsState(states []State, state State) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
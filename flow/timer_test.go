@@ -0,0 +1,113 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/necrobits/x/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func paymentTimeoutTable() TransitionTable {
+	return TransitionTable{
+		"AwaitingPayment": StateConfig{
+			Handler: emit("Paid"),
+			After: []Timer{
+				{Delay: 15 * time.Minute, Event: "PaymentTimedOut"},
+				{Delay: 10 * time.Minute, Event: "Reminded"},
+			},
+			Transitions: Transitions{
+				"Paid":            "Shipping",
+				"PaymentTimedOut": "Canceled",
+				"Reminded":        "AwaitingPaymentReminded",
+			},
+		},
+		"AwaitingPaymentReminded": StateConfig{
+			Handler: emit("Paid"),
+			Transitions: Transitions{
+				"Paid":            "Shipping",
+				"PaymentTimedOut": "Canceled",
+			},
+			After: []Timer{
+				{Delay: 30 * time.Minute, Event: "PaymentTimedOut"},
+			},
+		},
+		"Shipping": StateConfig{Final: true},
+		"Canceled": StateConfig{Final: true},
+	}
+}
+
+func TestTimers(t *testing.T) {
+	ctx := context.Background()
+	t.Run("NotDue", func(t *testing.T) {
+		f := newTestFlow(paymentTimeoutTable(), "AwaitingPayment", nil)
+		require.Len(t, f.Deadlines(), 2)
+		require.NoError(t, f.Tick(ctx, time.Now().Add(time.Minute)))
+		require.Equal(t, State("AwaitingPayment"), f.CurrentState())
+	})
+
+	t.Run("FireInOrder", func(t *testing.T) {
+		f := newTestFlow(paymentTimeoutTable(), "AwaitingPayment", nil)
+		require.NoError(t, f.Tick(ctx, time.Now().Add(11*time.Minute)))
+		require.Equal(t, State("AwaitingPaymentReminded"), f.CurrentState())
+		require.Len(t, f.Deadlines(), 1)
+
+		require.NoError(t, f.Tick(ctx, time.Now().Add(42*time.Minute)))
+		require.Equal(t, State("Canceled"), f.CurrentState())
+		require.True(t, f.IsCompleted())
+		require.Empty(t, f.Deadlines())
+	})
+
+	t.Run("ChainedAtTickTime", func(t *testing.T) {
+		start := time.Now().Add(24 * time.Hour)
+		f := newTestFlow(paymentTimeoutTable(), "AwaitingPayment", nil)
+		reminded := start.Add(11 * time.Minute)
+		require.NoError(t, f.Tick(ctx, reminded))
+		require.Equal(t, State("AwaitingPaymentReminded"), f.CurrentState())
+		require.Equal(t, []Deadline{
+			{State: "AwaitingPaymentReminded", Event: "PaymentTimedOut", DueAt: reminded.Add(30 * time.Minute)},
+		}, f.Deadlines())
+
+		require.NoError(t, f.Tick(ctx, reminded.Add(29*time.Minute)))
+		require.Equal(t, State("AwaitingPaymentReminded"), f.CurrentState())
+		require.NoError(t, f.Tick(ctx, reminded.Add(30*time.Minute)))
+		require.Equal(t, State("Canceled"), f.CurrentState())
+	})
+
+	t.Run("StoppedOnExit", func(t *testing.T) {
+		f := newTestFlow(paymentTimeoutTable(), "AwaitingPayment", nil)
+		require.NoError(t, f.HandleAction(ctx, testAction{"Pay"}))
+		require.Equal(t, State("Shipping"), f.CurrentState())
+		require.Empty(t, f.Deadlines())
+	})
+
+	t.Run("ExpiredAtTickTime", func(t *testing.T) {
+		f := newTestFlow(paymentTimeoutTable(), "AwaitingPayment", nil)
+		f.SetExpirationIn(20 * time.Minute)
+		require.NoError(t, f.Tick(ctx, time.Now().Add(11*time.Minute)))
+		require.Equal(t, State("AwaitingPaymentReminded"), f.CurrentState())
+
+		err := f.Tick(ctx, time.Now().Add(31*time.Minute))
+		require.True(t, errors.Is(err, ErrFlowExpired))
+		require.Equal(t, State("AwaitingPaymentReminded"), f.CurrentState())
+		require.Len(t, f.Deadlines(), 1)
+	})
+
+	t.Run("RestoredSnapshot", func(t *testing.T) {
+		f := newTestFlow(paymentTimeoutTable(), "AwaitingPayment", nil)
+		s, err := f.ToSnapshot()
+		require.NoError(t, err)
+		encoded, err := json.Marshal(s)
+		require.NoError(t, err)
+		var decoded Snapshot
+		require.NoError(t, json.Unmarshal(encoded, &decoded))
+
+		restored := FromSnapshot(&decoded, paymentTimeoutTable())
+		require.Len(t, restored.Deadlines(), 2)
+		require.NoError(t, restored.Tick(ctx, time.Now().Add(time.Hour)))
+		require.Equal(t, State("AwaitingPaymentReminded"), restored.CurrentState())
+		require.Len(t, restored.Deadlines(), 1)
+	})
+}
@@ -0,0 +1,308 @@
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/necrobits/x/errors"
+)
+
+// IssueType identifies the kind of problem found in a TransitionTable.
+type IssueType string
+
+const (
+	// IssueUndefinedState means that a state is referenced, e.g. as a target, parent or region, but it is not defined.
+	IssueUndefinedState IssueType = "undefined_state"
+	// IssueUnreachableState means that a state can never be reached from the initial state.
+	IssueUnreachableState IssueType = "unreachable_state"
+	// IssueDeadEnd means that a state is not final, but it has no outgoing transitions.
+	IssueDeadEnd IssueType = "dead_end"
+	// IssueAutopassWithoutTransitions means that an autopass state has no transitions to pass to.
+	IssueAutopassWithoutTransitions IssueType = "autopass_without_transitions"
+	// IssueAutopassCycle means that autopass states transition to each other in a cycle.
+	IssueAutopassCycle IssueType = "autopass_cycle"
+	// IssueMissingHandler means that neither a state nor its ancestors have a handler.
+	// It can be ignored, if the flow has a default handler.
+	IssueMissingHandler IssueType = "missing_handler"
+	// IssueInvalidHierarchy means that nested or parallel states are not configured correctly,
+	// e.g. a compound state without an initial state.
+	IssueInvalidHierarchy IssueType = "invalid_hierarchy"
+)
+
+// ValidationIssue is a problem found in a TransitionTable.
+type ValidationIssue struct {
+	Type  IssueType `json:"type"`
+	State State     `json:"state,omitempty"`
+	Msg   string    `json:"msg"`
+}
+
+// ValidationReport contains all problems found in a TransitionTable.
+type ValidationReport struct {
+	Issues []ValidationIssue `json:"issues"`
+}
+
+// Valid reports whether no issues were found.
+func (r *ValidationReport) Valid() bool {
+	return len(r.Issues) == 0
+}
+
+// Err returns an error with the code [ErrInvalidTransitionTable] describing all issues,
+// or nil if the table is valid.
+func (r *ValidationReport) Err() error {
+	if r.Valid() {
+		return nil
+	}
+	msgs := make([]string, 0, len(r.Issues))
+	for _, issue := range r.Issues {
+		msgs = append(msgs, issue.Msg)
+	}
+	return errors.B().
+		Code(ErrInvalidTransitionTable).
+		Op("flow.Validate").
+		Msgf("invalid transition table: %s", strings.Join(msgs, "; ")).Build()
+}
+
+func (r *ValidationReport) add(issueType IssueType, state State, format string, args ...any) {
+	r.Issues = append(r.Issues, ValidationIssue{
+		Type:  issueType,
+		State: state,
+		Msg:   fmt.Sprintf(format, args...),
+	})
+}
+
+// without returns a copy of the report without the issues of the given type.
+func (r *ValidationReport) without(issueType IssueType) *ValidationReport {
+	filtered := &ValidationReport{}
+	for _, issue := range r.Issues {
+		if issue.Type != issueType {
+			filtered.Issues = append(filtered.Issues, issue)
+		}
+	}
+	return filtered
+}
+
+// Validate checks a TransitionTable for problems, which would otherwise only show up at runtime.
+// It reports:
+//   - states which are referenced, but not defined.
+//   - states which cannot be reached from the initial state.
+//   - non-final states without outgoing transitions.
+//   - autopass states without transitions, or autopass states forming a cycle.
+//   - states without a handler or a sub-flow. These can be ignored if the flow has a default handler.
+//   - misconfigured nested or parallel states.
+func Validate(table TransitionTable, initial State) *ValidationReport {
+	report := &ValidationReport{}
+	if _, ok := table[initial]; !ok {
+		report.add(IssueUndefinedState, initial, "initial state %s is not defined", initial)
+		return report
+	}
+	states := sortedStates(table)
+	if _, ok := table[AnyState]; ok {
+		validateReferences(report, table, AnyState)
+	}
+	for _, state := range states {
+		validateReferences(report, table, state)
+		validateHierarchy(report, table, state)
+	}
+	reachable := reachableStates(table, initial)
+	for _, state := range states {
+		if !reachable[state] {
+			report.add(IssueUnreachableState, state, "state %s is unreachable from %s", state, initial)
+		}
+		validateLeaf(report, table, state)
+	}
+	validateAutopassCycles(report, table, states)
+	return report
+}
+
+func sortedStates(table TransitionTable) []State {
+	states := make([]State, 0, len(table))
+	for state := range table {
+		if state == AnyState {
+			continue
+		}
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i] < states[j] })
+	return states
+}
+
+// targets returns the targets of all transitions declared by a state, sorted by event.
+func (c StateConfig) targets() []State {
+	targets := make([]State, 0)
+	for _, event := range sortedEvents(c.Transitions) {
+		targets = append(targets, c.Transitions[event])
+	}
+	events := make([]Event, 0, len(c.GuardedTransitions))
+	for event := range c.GuardedTransitions {
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i] < events[j] })
+	for _, event := range events {
+		for _, candidate := range c.GuardedTransitions[event] {
+			targets = append(targets, candidate.Target)
+		}
+	}
+	return targets
+}
+
+func sortedEvents(transitions Transitions) []Event {
+	events := make([]Event, 0, len(transitions))
+	for event := range transitions {
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i] < events[j] })
+	return events
+}
+
+func validateReferences(report *ValidationReport, table TransitionTable, state State) {
+	config := table[state]
+	for _, target := range config.targets() {
+		if _, ok := table[target]; !ok {
+			report.add(IssueUndefinedState, state, "state %s has a transition to undefined state %s", state, target)
+		}
+	}
+	if _, ok := table[config.Parent]; config.Parent != "" && !ok {
+		report.add(IssueUndefinedState, state, "parent %s of state %s is not defined", config.Parent, state)
+	}
+	if _, ok := table[config.Initial]; config.Initial != "" && !ok {
+		report.add(IssueUndefinedState, state, "initial state %s of state %s is not defined", config.Initial, state)
+	}
+	for _, region := range config.Regions {
+		if _, ok := table[region]; !ok {
+			report.add(IssueUndefinedState, state, "region %s of state %s is not defined", region, state)
+		}
+	}
+	for _, excluded := range config.Except {
+		if _, ok := table[excluded]; !ok {
+			report.add(IssueUndefinedState, state, "excluded state %s of state %s is not defined", excluded, state)
+		}
+	}
+}
+
+func validateHierarchy(report *ValidationReport, table TransitionTable, state State) {
+	config := table[state]
+	path := table.Path(state)
+	if len(path) > len(table) {
+		report.add(IssueInvalidHierarchy, state, "state %s is its own ancestor", state)
+		return
+	}
+	children := table.Children(state)
+	if config.Initial != "" && table[config.Initial].Parent != state {
+		report.add(IssueInvalidHierarchy, state, "initial state %s is not a child of state %s", config.Initial, state)
+	}
+	if config.Initial != "" && len(config.Regions) > 0 {
+		report.add(IssueInvalidHierarchy, state, "parallel state %s cannot have an initial state", state)
+	}
+	if len(children) > 0 && config.Initial == "" && len(config.Regions) == 0 {
+		report.add(IssueInvalidHierarchy, state, "compound state %s has no initial state", state)
+	}
+	for _, region := range config.Regions {
+		if table[region].Parent != state {
+			report.add(IssueInvalidHierarchy, state, "region %s is not a child of parallel state %s", region, state)
+		}
+		if !table.IsCompound(region) {
+			report.add(IssueInvalidHierarchy, state, "region %s of parallel state %s is not a compound state", region, state)
+		}
+	}
+	for _, ancestor := range path[:len(path)-1] {
+		if table.IsParallel(ancestor) && table.IsParallel(state) {
+			report.add(IssueInvalidHierarchy, state, "parallel state %s cannot be nested in parallel state %s", state, ancestor)
+			break
+		}
+	}
+}
+
+// validateLeaf checks the states, in which the flow can actually stay.
+func validateLeaf(report *ValidationReport, table TransitionTable, state State) {
+	config := table[state]
+	if table.IsCompound(state) || config.Final {
+		return
+	}
+	hasTransitions, hasHandler := false, false
+	for _, s := range table.transitionPath(state) {
+		hasTransitions = hasTransitions || len(table[s].targets()) > 0
+		hasHandler = hasHandler || table[s].Handler != nil || table[s].Invoke != nil
+	}
+	if table.IsParallel(state) {
+		hasHandler = true
+	}
+	if !hasTransitions && config.Autopass {
+		report.add(IssueAutopassWithoutTransitions, state, "autopass state %s has no transitions", state)
+	} else if !hasTransitions {
+		report.add(IssueDeadEnd, state, "state %s is not final, but it has no transitions", state)
+	}
+	if !hasHandler {
+		report.add(IssueMissingHandler, state, "state %s has no handler", state)
+	}
+}
+
+// reachableStates returns the states, which can be reached from the initial state.
+// When a state is reached, its ancestors, its initial state and its regions are reached as well.
+func reachableStates(table TransitionTable, initial State) map[State]bool {
+	reachable := make(map[State]bool)
+	queue := []State{initial}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		if _, ok := table[state]; !ok || reachable[state] {
+			continue
+		}
+		reachable[state] = true
+		config := table[state]
+		queue = append(queue, table.Path(state)...)
+		if config.Initial != "" {
+			queue = append(queue, config.Initial)
+		}
+		queue = append(queue, config.Regions...)
+		queue = append(queue, config.targets()...)
+		if table.hasGlobalTransitions(state) {
+			queue = append(queue, table[AnyState].targets()...)
+		}
+	}
+	return reachable
+}
+
+// validateAutopassCycles finds cycles of autopass states, which would pass to each other forever.
+func validateAutopassCycles(report *ValidationReport, table TransitionTable, states []State) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[State]int)
+	var stack []State
+	var visit func(state State)
+	visit = func(state State) {
+		marks[state] = visiting
+		stack = append(stack, state)
+		for _, s := range table.transitionPath(state) {
+			for _, target := range table[s].targets() {
+				next := table.InitialLeaf(target)
+				if !table[next].Autopass {
+					continue
+				}
+				switch marks[next] {
+				case unvisited:
+					visit(next)
+				case visiting:
+					cycle := []string{}
+					for i := len(stack) - 1; i >= 0; i-- {
+						cycle = append([]string{string(stack[i])}, cycle...)
+						if stack[i] == next {
+							break
+						}
+					}
+					report.add(IssueAutopassCycle, next, "autopass states form a cycle: %s -> %s", strings.Join(cycle, " -> "), next)
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		marks[state] = visited
+	}
+	for _, state := range states {
+		if table[state].Autopass && marks[state] == unvisited {
+			visit(state)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package flow
+
+import (
+	"testing"
+
+	"github.com/necrobits/x/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func issuesOf(report *ValidationReport) map[IssueType][]State {
+	issues := make(map[IssueType][]State)
+	for _, issue := range report.Issues {
+		issues[issue.Type] = append(issues[issue.Type], issue.State)
+	}
+	return issues
+}
+
+func TestValidate(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		require.True(t, Validate(checkoutTable(), "Checkout").without(IssueMissingHandler).Valid())
+		require.True(t, Validate(fulfillmentTable(), "Fulfillment").Valid())
+	})
+
+	t.Run("UndefinedInitialState", func(t *testing.T) {
+		report := Validate(checkoutTable(), "Unknown")
+		require.Equal(t, map[IssueType][]State{IssueUndefinedState: {"Unknown"}}, issuesOf(report))
+	})
+
+	t.Run("Issues", func(t *testing.T) {
+		table := TransitionTable{
+			"Start": StateConfig{
+				Handler:     emit("Next"),
+				Transitions: Transitions{"Next": "Sart", "Skip": "A"},
+			},
+			"A": StateConfig{
+				Handler:     emit("Next"),
+				Autopass:    true,
+				Transitions: Transitions{"Next": "B"},
+			},
+			"B": StateConfig{
+				Handler:     emit("Next"),
+				Autopass:    true,
+				Transitions: Transitions{"Next": "A"},
+			},
+			"Stuck":       StateConfig{Handler: emit("Next")},
+			"NoHandler":   StateConfig{Transitions: Transitions{"Next": "Start"}},
+			"Passthrough": StateConfig{Autopass: true, Handler: emit("Next")},
+		}
+		issues := issuesOf(Validate(table, "Start"))
+		require.Equal(t, []State{"Start"}, issues[IssueUndefinedState])
+		require.Equal(t, []State{"NoHandler", "Passthrough", "Stuck"}, issues[IssueUnreachableState])
+		require.Equal(t, []State{"Stuck"}, issues[IssueDeadEnd])
+		require.Equal(t, []State{"Passthrough"}, issues[IssueAutopassWithoutTransitions])
+		require.Equal(t, []State{"A"}, issues[IssueAutopassCycle])
+		require.Equal(t, []State{"NoHandler"}, issues[IssueMissingHandler])
+	})
+
+	t.Run("InvalidHierarchy", func(t *testing.T) {
+		table := checkoutTable()
+		payment := table["Payment"]
+		payment.Initial = ""
+		table["Payment"] = payment
+		issues := issuesOf(Validate(table, "Checkout"))
+		require.Equal(t, []State{"Payment"}, issues[IssueInvalidHierarchy])
+	})
+
+	t.Run("StrictNew", func(t *testing.T) {
+		opts := CreateFlowOpts{
+			ID:              "1",
+			Type:            "Checkout",
+			InitialState:    "Checkout",
+			TransitionTable: checkoutTable(),
+			Strict:          true,
+		}
+		require.NotPanics(t, func() {
+			opts.Handler = emit("Submitted")
+			New(opts)
+		})
+		opts.Handler = nil
+		var err error
+		func() {
+			defer func() { err, _ = recover().(error) }()
+			New(opts)
+		}()
+		require.True(t, errors.Is(err, ErrInvalidTransitionTable))
+	})
+}
@@ -0,0 +1,40 @@
+package flow
+
+// AnyState is a reserved state of a TransitionTable, which holds the global transitions of the flow.
+// For example, to cancel an order in every state, except when it is already shipped:
+//
+//	flow.AnyState: flow.StateConfig{
+//		Transitions: flow.Transitions{
+//			Canceled: Canceled,
+//		},
+//		Except: []flow.State{Shipped},
+//	}
+//
+// The global transitions are consulted in every non-final state, after the transitions of the state and its ancestors
+// did not match the event. Only Transitions, GuardedTransitions and Except are used, the flow never enters AnyState.
+const AnyState State = "*"
+
+// hasGlobalTransitions reports whether the global transitions apply to a state.
+// They do not apply to final states, and to the excluded states and their children.
+func (t TransitionTable) hasGlobalTransitions(state State) bool {
+	global, ok := t[AnyState]
+	if !ok || state == AnyState || t[state].Final {
+		return false
+	}
+	for _, s := range t.Path(state) {
+		if containsState(global.Except, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// transitionPath returns the states, whose transitions apply to a state, from the outermost.
+// If the global transitions apply to the state, AnyState comes first, so it is consulted last.
+func (t TransitionTable) transitionPath(state State) []State {
+	path := t.Path(state)
+	if t.hasGlobalTransitions(state) {
+		path = append([]State{AnyState}, path...)
+	}
+	return path
+}
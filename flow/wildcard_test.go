@@ -0,0 +1,80 @@
+package flow
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobalTransitions(t *testing.T) {
+	ctx := context.Background()
+	table := TransitionTable{
+		"Cart": StateConfig{
+			Transitions: Transitions{"Next": "Payment", "Cancel": "Abandoned"},
+		},
+		"Payment": StateConfig{
+			Transitions: Transitions{"Next": "Fulfilment"},
+		},
+		"Fulfilment": StateConfig{Initial: "Packing"},
+		"Packing": StateConfig{
+			Parent:      "Fulfilment",
+			Transitions: Transitions{"Next": "Shipped"},
+		},
+		"Shipped": StateConfig{
+			Transitions: Transitions{"Next": "Delivered"},
+		},
+		"Delivered": StateConfig{Final: true},
+		"Abandoned": StateConfig{Final: true},
+		"Canceled":  StateConfig{Final: true},
+		AnyState: StateConfig{
+			Transitions: Transitions{"Cancel": "Canceled"},
+			Except:      []State{"Fulfilment"},
+		},
+	}
+	t.Run("Fallback", func(t *testing.T) {
+		for _, initial := range []State{"Payment", "Shipped"} {
+			f := newTestFlow(table, initial, nil).WithDefaultActionHandler(emitActionType)
+			require.NoError(t, f.HandleAction(ctx, testAction{"Cancel"}))
+			require.Equal(t, State("Canceled"), f.CurrentState())
+			require.True(t, f.IsCompleted())
+		}
+	})
+
+	t.Run("StateTakesPrecedence", func(t *testing.T) {
+		f := newTestFlow(table, "Cart", nil).WithDefaultActionHandler(emitActionType)
+		require.NoError(t, f.HandleAction(ctx, testAction{"Cancel"}))
+		require.Equal(t, State("Abandoned"), f.CurrentState())
+	})
+
+	t.Run("Excluded", func(t *testing.T) {
+		f := newTestFlow(table, "Payment", nil).WithDefaultActionHandler(emitActionType)
+		require.NoError(t, f.HandleAction(ctx, testAction{"Next"}))
+		require.Equal(t, State("Packing"), f.CurrentState())
+		require.Error(t, f.HandleAction(ctx, testAction{"Cancel"}))
+		require.Equal(t, State("Packing"), f.CurrentState())
+	})
+
+	t.Run("FinalStates", func(t *testing.T) {
+		require.False(t, table.hasGlobalTransitions("Delivered"))
+		require.True(t, table.hasGlobalTransitions("Cart"))
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		require.True(t, Validate(table, "Cart").without(IssueMissingHandler).Valid())
+
+		invalid := TransitionTable{
+			"Start": StateConfig{Handler: emit("Next"), Transitions: Transitions{"Next": "Start"}},
+			AnyState: StateConfig{
+				Transitions: Transitions{"Cancel": "Canceled"},
+				Except:      []State{"Unknown"},
+			},
+		}
+		report := Validate(invalid, "Start")
+		require.Len(t, report.Issues, 2)
+		for _, issue := range report.Issues {
+			require.Equal(t, IssueUndefinedState, issue.Type)
+			require.Equal(t, AnyState, issue.State)
+		}
+	})
+}
@@ -2,6 +2,8 @@ package flowviz
 
 import (
 	"bytes"
+	"fmt"
+	"strings"
 
 	"github.com/goccy/go-graphviz"
 	"github.com/goccy/go-graphviz/cgraph"
@@ -17,6 +19,10 @@ const (
 
 // CreateGraphvizForFlow creates a graphviz graph for the given flow.TransitionTable
 // and writes it to the given buffer.
+// Compound states are rendered as clusters containing their children,
+// parallel states are rendered as dashed clusters containing their regions.
+// The global transitions of flow.AnyState are rendered as dotted edges from a single "any state" node,
+// which lists the excluded states, instead of an edge from every state.
 // Supported formats are: VizFormatDot, VizFormatPNG, VizFormatSVG, VizFormatJPG
 func CreateGraphvizForFlow(transitionTable flow.TransitionTable, format graphviz.Format, buffer *bytes.Buffer) error {
 	g := graphviz.New()
@@ -24,35 +30,169 @@ func CreateGraphvizForFlow(transitionTable flow.TransitionTable, format graphviz
 	if err != nil {
 		return err
 	}
-	createdNodes := make(map[string]*cgraph.Node)
+	graph.SetCompound(true)
+	b := &vizBuilder{
+		table:    transitionTable,
+		graph:    graph,
+		clusters: make(map[flow.State]*cgraph.Graph),
+	}
 	for state, stateConfig := range transitionTable {
+		if state == flow.AnyState {
+			continue
+		}
 		var sNode *cgraph.Node
-		sName := string(state)
-		if sNode, err = graph.CreateNode(sName); err != nil {
+		if sNode, err = b.node(state); err != nil {
 			return err
 		}
-		if stateConfig.Final {
+		if stateConfig.Final && !b.isCluster(state) {
 			sNode.SetPenWidth(3)
 		}
 		for event, nextState := range stateConfig.Transitions {
-			tName := string(nextState)
-			e := string(event)
-			var tNode *cgraph.Node
-			var edge *cgraph.Edge
-			if _, ok := createdNodes[tName]; !ok {
-				if tNode, err = graph.CreateNode(tName); err != nil {
+			if _, err = b.edge(state, nextState, string(event)); err != nil {
+				return err
+			}
+		}
+		for event, candidates := range stateConfig.GuardedTransitions {
+			for i, candidate := range candidates {
+				var edge *cgraph.Edge
+				e := fmt.Sprintf("%s [%s]", event, guardLabel(i, candidate))
+				if edge, err = b.edge(state, candidate.Target, e); err != nil {
 					return err
 				}
+				edge.SetStyle(cgraph.DashedEdgeStyle)
 			}
-			if edge, err = graph.CreateEdge(e, sNode, tNode); err != nil {
-				return err
-			}
-			edge.SetLabel(e)
-			edge.SetFontSize(12)
 		}
 	}
+	if err := b.globalTransitions(); err != nil {
+		return err
+	}
 	if err := g.Render(graph, format, buffer); err != nil {
 		return err
 	}
 	return nil
 }
+
+// vizBuilder keeps track of the clusters created for compound states.
+type vizBuilder struct {
+	table    flow.TransitionTable
+	graph    *cgraph.Graph
+	clusters map[flow.State]*cgraph.Graph
+}
+
+// container returns the graph in which the children of a state are drawn.
+// For a state without a parent, it is the root graph.
+func (b *vizBuilder) container(parent flow.State) *cgraph.Graph {
+	if parent == "" {
+		return b.graph
+	}
+	if cluster, ok := b.clusters[parent]; ok {
+		return cluster
+	}
+	cluster := b.container(b.table[parent].Parent).SubGraph(clusterName(parent), 1)
+	cluster.SetLabel(string(parent))
+	if b.table.IsParallel(parent) {
+		cluster.SetStyle(cgraph.DashedGraphStyle)
+	}
+	b.clusters[parent] = cluster
+	return cluster
+}
+
+// node returns the node representing a state.
+// A compound state is represented by the node of its initial leaf state,
+// and a parallel state by the node representing its first region.
+func (b *vizBuilder) node(state flow.State) (*cgraph.Node, error) {
+	for i := 0; i < len(b.table); i++ {
+		state = b.table.InitialLeaf(state)
+		if !b.table.IsParallel(state) {
+			break
+		}
+		state = b.table[state].Regions[0]
+	}
+	return b.container(b.table[state].Parent).CreateNode(string(state))
+}
+
+func (b *vizBuilder) isCluster(state flow.State) bool {
+	return b.table.IsCompound(state) || b.table.IsParallel(state)
+}
+
+// edge creates an edge between two states.
+// If one of the states is a compound state, the edge is clipped at the border of its cluster.
+func (b *vizBuilder) edge(from flow.State, to flow.State, label string) (*cgraph.Edge, error) {
+	var err error
+	var sNode, tNode *cgraph.Node
+	var edge *cgraph.Edge
+	if sNode, err = b.node(from); err != nil {
+		return nil, err
+	}
+	if tNode, err = b.node(to); err != nil {
+		return nil, err
+	}
+	if edge, err = b.graph.CreateEdge(fmt.Sprintf("%s/%s", from, label), sNode, tNode); err != nil {
+		return nil, err
+	}
+	if b.isCluster(from) {
+		edge.SetLogicalTail(clusterName(from))
+	}
+	if b.isCluster(to) {
+		edge.SetLogicalHead(clusterName(to))
+	}
+	edge.SetLabel(label)
+	edge.SetFontSize(12)
+	return edge, nil
+}
+
+// globalTransitions draws the transitions of flow.AnyState, if the table has any.
+func (b *vizBuilder) globalTransitions() error {
+	global, ok := b.table[flow.AnyState]
+	if !ok {
+		return nil
+	}
+	node, err := b.node(flow.AnyState)
+	if err != nil {
+		return err
+	}
+	label := "any state"
+	if len(global.Except) > 0 {
+		excluded := make([]string, 0, len(global.Except))
+		for _, state := range global.Except {
+			excluded = append(excluded, string(state))
+		}
+		label = fmt.Sprintf("any state\nexcept %s", strings.Join(excluded, ", "))
+	}
+	node.SetLabel(label)
+	node.SetShape(cgraph.BoxShape)
+	node.SetStyle(cgraph.DashedNodeStyle)
+	for event, nextState := range global.Transitions {
+		var edge *cgraph.Edge
+		if edge, err = b.edge(flow.AnyState, nextState, string(event)); err != nil {
+			return err
+		}
+		edge.SetStyle(cgraph.DottedEdgeStyle)
+	}
+	for event, candidates := range global.GuardedTransitions {
+		for i, candidate := range candidates {
+			var edge *cgraph.Edge
+			e := fmt.Sprintf("%s [%s]", event, guardLabel(i, candidate))
+			if edge, err = b.edge(flow.AnyState, candidate.Target, e); err != nil {
+				return err
+			}
+			edge.SetStyle(cgraph.DottedEdgeStyle)
+		}
+	}
+	return nil
+}
+
+func clusterName(state flow.State) string {
+	return "cluster_" + string(state)
+}
+
+// guardLabel describes the guard of a candidate, which is shown next to the event.
+func guardLabel(index int, candidate flow.GuardedTarget) string {
+	if candidate.Name != "" {
+		return candidate.Name
+	}
+	if candidate.Guard == nil {
+		return "else"
+	}
+	return fmt.Sprintf("guard #%d", index+1)
+}
@@ -2,12 +2,14 @@ module github.com/necrobits/x
 
 go 1.19
 
-require github.com/goccy/go-graphviz v0.1.1
+require (
+	github.com/goccy/go-graphviz v0.1.1
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
 require (